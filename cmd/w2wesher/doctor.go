@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/doctor"
+)
+
+// doctorCommand checks the environment and exits with a non-zero code on failures.
+// Nothing is written: the config is never migrated and the keys are never generated.
+func doctorCommand(overrides config.Overrides, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: doctor")
+	}
+
+	cfg, err := config.LoadReadOnly(*configFile, *stateFile, overrides)
+	if err != nil {
+		fmt.Printf("[FAIL] config: %v\n", err)
+		os.Exit(1)
+	}
+
+	results := doctor.Run(cfg)
+
+	err = doctor.Print(os.Stdout, results)
+	if err != nil {
+		return err
+	}
+
+	if doctor.Failed(results) {
+		os.Exit(1)
+	}
+
+	return nil
+}
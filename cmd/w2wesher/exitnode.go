@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/control"
+)
+
+// exitNodeCommand shows or changes the exit node of the running daemon.
+func exitNodeCommand(overrides config.Overrides, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: exit-node [<peer-id> | off | config]")
+	}
+
+	client, err := controlClient(overrides)
+	if err != nil {
+		return err
+	}
+
+	var exit *control.ExitNode
+	switch {
+	case len(args) == 0:
+		status, err := client.Status(context.Background())
+		if err != nil {
+			return err
+		}
+		exit = &control.ExitNode{Peer: status.ExitNode, Active: status.ExitNodeActive}
+	case args[0] == "config":
+		// follow Wireguard.UseExitNode again
+		exit, err = client.SelectExitNode(context.Background(), "")
+	default:
+		exit, err = client.SelectExitNode(context.Background(), args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case exit.Peer == "":
+		_, err = fmt.Fprintln(os.Stdout, "exit node: none")
+	case exit.Active:
+		_, err = fmt.Fprintf(os.Stdout, "exit node: %s (active)\n", exit.Peer)
+	default:
+		_, err = fmt.Fprintf(os.Stdout, "exit node: %s (not available)\n", exit.Peer)
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/export"
+	"github.com/derlaft/w2wesher/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// exportCommand prints the static wireguard configuration of the mesh
+// for a device which can not run w2wesher.
+func exportCommand(overrides config.Overrides, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		format   = fs.String("format", "wg-quick", "output format: wg-quick, networkd or json")
+		generate = fs.Bool("generate", false, "generate a keypair and an overlay address for the device")
+		name     = fs.String("name", "", "device name the overlay address is derived from, required with -generate")
+		iface    = fs.String("interface", "", "interface name on the device (default: same as on this node)")
+		out      = fs.String("out", "", "write the files to the directory instead of stdout")
+	)
+	_ = fs.Parse(args)
+
+	client, err := controlClient(overrides)
+	if err != nil {
+		return err
+	}
+
+	mesh, err := client.Export(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if *iface != "" {
+		mesh.Interface.Name = *iface
+	}
+
+	if *generate {
+		err = generateDevice(mesh, *name)
+		if err != nil {
+			return err
+		}
+	}
+
+	type file struct {
+		suffix string
+		write  func(io.Writer, *export.Mesh) error
+	}
+
+	var files []file
+	switch *format {
+	case "wg-quick":
+		files = []file{{".conf", export.WriteWgQuick}}
+	case "networkd":
+		files = []file{{".netdev", export.WriteNetdev}, {".network", export.WriteNetwork}}
+	case "json":
+		files = []file{{".json", export.WriteJSON}}
+	default:
+		return fmt.Errorf("unknown format %q, expected wg-quick, networkd or json", *format)
+	}
+
+	for i, f := range files {
+		filename := mesh.Interface.Name + f.suffix
+
+		if *out == "" {
+			if len(files) > 1 {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("# --- %s ---\n", filename)
+			}
+
+			err = f.write(os.Stdout, mesh)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = writeExport(filepath.Join(*out, filename), mesh, f.write)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *generate {
+		fmt.Fprintf(os.Stderr, "device public key: %s\n", mesh.Interface.PublicKey)
+	}
+
+	return nil
+}
+
+// generateDevice adds a new keypair and the overlay address to the exported mesh.
+func generateDevice(mesh *export.Mesh, name string) error {
+	if name == "" {
+		return fmt.Errorf("export: -name is required with -generate")
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+
+	prefix, err := netip.ParsePrefix(mesh.Interface.NetworkRange)
+	if err != nil {
+		return err
+	}
+
+	addr, err := wg.OverlayAddr(prefix, name)
+	if err != nil {
+		return err
+	}
+
+	mesh.Interface.PrivateKey = key.String()
+	mesh.Interface.PublicKey = key.PublicKey().String()
+	mesh.Interface.Address = netip.PrefixFrom(addr, prefix.Bits()).String()
+
+	if mesh.Interface.NetworkRange4 == "" {
+		return nil
+	}
+
+	prefix4, err := netip.ParsePrefix(mesh.Interface.NetworkRange4)
+	if err != nil {
+		return err
+	}
+
+	addr4, err := wg.OverlayAddr(prefix4, name)
+	if err != nil {
+		return err
+	}
+
+	mesh.Interface.Address4 = netip.PrefixFrom(addr4, prefix4.Bits()).String()
+
+	return nil
+}
+
+// writeExport writes the file readable only by the owner: it might contain the private key.
+func writeExport(filename string, mesh *export.Mesh, write func(io.Writer, *export.Mesh) error) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = write(f, mesh)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/derlaft/w2wesher/config"
+)
+
+// initCommand writes a fresh config and generates the keys without starting.
+func initCommand(overrides config.Overrides, args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	force := fs.Bool("force", false, "overwrite the existing config, the previous one is kept as a backup")
+	_ = fs.Parse(args)
+
+	err := config.Init(*configFile, *force)
+	if err != nil {
+		return err
+	}
+
+	// generate the keys
+	_, err = config.Load(*configFile, *stateFile, overrides)
+	if err != nil {
+		return err
+	}
+
+	log.
+		With("config", *configFile).
+		With("state", *stateFile).
+		Info("configuration created")
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/invite"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// inviteCommand prints a token new nodes can join the network with.
+// The addrs are taken from the state file maintained by the running node.
+func inviteCommand(overrides config.Overrides, args []string) error {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	var (
+		expire   = fs.Duration("expire", 24*time.Hour, "token lifetime, 0 for no expiry")
+		once     = fs.Bool("once", false, "make the token one-time-use")
+		maxPeers = fs.Int("peers", 3, "maximal number of other bootstrap peers to include")
+	)
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadReadOnly(*configFile, *stateFile, overrides)
+	if err != nil {
+		return err
+	}
+
+	if missing := cfg.Missing(); len(missing) > 0 {
+		return fmt.Errorf("%s not generated yet: make sure the node is running", strings.Join(missing, ", "))
+	}
+
+	pk, err := cfg.P2P.LoadPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	id, err := peer.IDFromPrivateKey(pk)
+	if err != nil {
+		return err
+	}
+
+	// this node goes first: it is the one which redeems the invite
+	var bootstrap []string
+	for _, addr := range cfg.State().Addrs() {
+		bootstrap = append(bootstrap, addr+"/p2p/"+id.String())
+	}
+
+	if len(bootstrap) == 0 {
+		return fmt.Errorf("addrs of this node are unknown: make sure it is running")
+	}
+
+	// add a few other known peers
+	var included = make(map[peer.ID]bool)
+	for _, addr := range cfg.State().Bootstrap() {
+		ai, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			continue
+		}
+
+		if !included[ai.ID] && len(included) >= *maxPeers {
+			continue
+		}
+
+		included[ai.ID] = true
+		bootstrap = append(bootstrap, addr)
+	}
+
+	t, err := invite.New(id, cfg.P2P.PSK, cfg.Wireguard.NetworkRange, cfg.Wireguard.NetworkRange4, bootstrap, invite.Options{
+		Expire: *expire,
+		Once:   *once,
+	})
+	if err != nil {
+		return err
+	}
+
+	token, err := t.Encode(pk)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(os.Stdout, token)
+	return err
+}
+
+// joinCommand writes the network settings from the token to the config
+// and starts the daemon.
+func joinCommand(overrides config.Overrides, args []string) error {
+	err := notRoot()
+	if err != nil {
+		return err
+	}
+
+	err = join(overrides, args)
+	if err != nil {
+		return err
+	}
+
+	return run(overrides)
+}
+
+// join writes the network settings from the token to the config.
+func join(overrides config.Overrides, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: join <token>")
+	}
+
+	t, err := invite.Decode(args[0])
+	if err != nil {
+		return err
+	}
+
+	if t.Expired() {
+		return invite.ErrExpired
+	}
+
+	_, err = t.BootstrapPeers()
+	if err != nil {
+		return err
+	}
+
+	err = config.Join(*configFile, t.PSK, t.NetworkRange, t.NetworkRange4, t.Bootstrap)
+	if err != nil {
+		return err
+	}
+
+	if t.Nonce == "" {
+		return nil
+	}
+
+	// one-time-use invite is redeemed on start
+	state, err := config.LoadState(*stateFile)
+	if err != nil {
+		return err
+	}
+
+	return state.SetPendingInvite(args[0])
+}
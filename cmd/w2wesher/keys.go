@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// genkeyCommand prints a new key of the requested type.
+func genkeyCommand(overrides config.Overrides, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: genkey p2p | wireguard | psk")
+	}
+
+	var generate func() (string, error)
+	switch args[0] {
+	case "p2p":
+		generate = config.GenerateP2PPrivateKey
+	case "wireguard":
+		generate = config.GenerateWireguardPrivateKey
+	case "psk":
+		generate = config.GeneratePsk
+	default:
+		return fmt.Errorf("unknown key type %q, expected p2p, wireguard or psk", args[0])
+	}
+
+	key, err := generate()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(os.Stdout, key)
+	return err
+}
+
+// pubkeyCommand prints the public identities derived from the config.
+// With an argument, only the requested value is printed, suitable for scripts.
+func pubkeyCommand(overrides config.Overrides, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: pubkey [wireguard | peer]")
+	}
+
+	cfg, err := config.LoadReadOnly(*configFile, *stateFile, overrides)
+	if err != nil {
+		return err
+	}
+
+	if missing := cfg.Missing(); len(missing) > 0 {
+		return fmt.Errorf("%s not generated yet: run init or start the daemon", strings.Join(missing, ", "))
+	}
+
+	wgKey, err := wgtypes.ParseKey(cfg.Wireguard.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	pk, err := cfg.P2P.LoadPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	id, err := peer.IDFromPrivateKey(pk)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		_, err = fmt.Fprintf(os.Stdout, "wireguard %s\npeer %s\n", wgKey.PublicKey(), id)
+		return err
+	}
+
+	switch args[0] {
+	case "wireguard":
+		_, err = fmt.Fprintln(os.Stdout, wgKey.PublicKey())
+	case "peer":
+		_, err = fmt.Fprintln(os.Stdout, id)
+	default:
+		err = fmt.Errorf("unknown key type %q, expected wireguard or peer", args[0])
+	}
+
+	return err
+}
+
+// keysCommand manages the keys of the running daemon.
+func keysCommand(overrides config.Overrides, args []string) error {
+	if len(args) != 1 || args[0] != "rotate" {
+		return fmt.Errorf("usage: keys rotate")
+	}
+
+	client, err := controlClient(overrides)
+	if err != nil {
+		return err
+	}
+
+	rotation, err := client.RotateKey(context.Background())
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "wireguard %s\nactivation %s\n",
+		rotation.NextPublicKey, rotation.Activation.Format(time.RFC3339))
+	return err
+}
@@ -1,15 +1,11 @@
 package main
 
 import (
-	"context"
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/derlaft/w2wesher/config"
-	"github.com/derlaft/w2wesher/networkstate"
-	"github.com/derlaft/w2wesher/p2p"
-	"github.com/derlaft/w2wesher/runnergroup"
-	"github.com/derlaft/w2wesher/wg"
 
 	logging "github.com/ipfs/go-log/v2"
 )
@@ -17,39 +13,82 @@ import (
 var log = logging.Logger("w2wesher")
 
 var (
-	configFile = flag.String("config", ".w2wesher.ini", "configuration file")
+	configFile           = flag.String("config", ".w2wesher.ini", "configuration file")
+	stateFile            = flag.String("state", "", "state file (default: state.ini in $STATE_DIRECTORY or next to the configuration file)")
+	dryRun               = flag.Bool("dry-run", false, "run the p2p side normally, but only record the wireguard changes instead of applying them")
+	printEffectiveConfig = flag.Bool("print-effective-config", false, "print the merged configuration with secrets redacted and exit (same as show-config)")
 )
 
-func main() {
-	flag.Parse()
+type command struct {
+	name string
+	args string
+	help string
+	run  func(overrides config.Overrides, args []string) error
+}
 
-	if os.Getuid() <= 0 || os.Getegid() <= 0 {
-		log.Fatal("w2wesher should never be started from root")
+var commands = []command{
+	{"run", "", "start the daemon (default)", runCommand},
+	{"init", "[-force]", "generate a fresh config and state without starting", initCommand},
+	{"genkey", "p2p | wireguard | psk", "generate a new key and print it", genkeyCommand},
+	{"pubkey", "[wireguard | peer]", "print the wireguard public key and the libp2p peer ID", pubkeyCommand},
+	{"keys", "rotate", "switch the running daemon to a new wireguard key", keysCommand},
+	{"exit-node", "[<peer-id> | off | config]", "show or change the exit node of the running daemon", exitNodeCommand},
+	{"doctor", "", "check the environment and print the fixes", doctorCommand},
+	{"show-config", "", "print the merged configuration with secrets redacted", showConfigCommand},
+	{"status", "[-json]", "show this node and the state of all the peers", statusCommand},
+	{"peers", "[-json]", "show the state of all the peers", peersCommand},
+	{"plan", "[-json] [-all]", "show the wireguard changes recorded in the dry-run mode", planCommand},
+	{"export", "[-format wg-quick|networkd|json] [-generate -name <name>]", "print the static wireguard configuration of the mesh", exportCommand},
+	{"invite", "[-expire 24h] [-once] [-peers 3]", "print a token for joining the network", inviteCommand},
+	{"join", "<token>", "write the network settings from the token and start the daemon", joinCommand},
+	{"version", "", "print the version", versionCommand},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] <command> [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %s %s\n    \t%s\n", c.name, c.args, c.help)
 	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
 
-	state := networkstate.New()
+func main() {
+	overrides := config.EnvOverrides()
+	overrides.RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
 
-	cfg, err := config.Load(*configFile)
-	if err != nil {
-		log.Fatal(err)
+	if *stateFile == "" {
+		*stateFile = config.DefaultStateFile(*configFile)
 	}
 
-	adapter, err := wg.New(cfg, state)
-	if err != nil {
-		log.Fatal(err)
+	name, args := "run", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
 
-	node, err := p2p.New(cfg, state, adapter)
-	if err != nil {
-		log.Fatal(err)
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+
+		err := c.run(overrides, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	err = runnergroup.New(context.TODO()).
-		Go(node.Run).
-		Go(adapter.Run).
-		Go(runnergroup.AbortOnSignal).
-		Wait()
-	if err != nil {
-		log.Error(err)
+	usage()
+	os.Exit(2)
+}
+
+func notRoot() error {
+	if os.Getuid() <= 0 || os.Getegid() <= 0 {
+		return fmt.Errorf("w2wesher should never be started from root")
 	}
+
+	return nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/derlaft/w2wesher/config"
+)
+
+// planCommand prints the wireguard changes recorded by the daemon running with -dry-run.
+func planCommand(overrides config.Overrides, args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	var (
+		asJSON = fs.Bool("json", false, "print JSON")
+		all    = fs.Bool("all", false, "include the operations which would not change anything")
+	)
+	_ = fs.Parse(args)
+
+	client, err := controlClient(overrides)
+	if err != nil {
+		return err
+	}
+
+	ops, err := client.DryRun(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ops)
+	}
+
+	for _, op := range ops {
+		if len(op.Diff) == 0 && !*all {
+			continue
+		}
+
+		fmt.Printf("%s %s\n", op.Time.Format("15:04:05"), op.Kind)
+		for _, line := range op.Config {
+			fmt.Printf("    %s\n", line)
+		}
+		if len(op.Diff) == 0 {
+			fmt.Println("  no changes")
+		} else {
+			fmt.Println("  changes:")
+		}
+		for _, line := range op.Diff {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/control"
+	"github.com/derlaft/w2wesher/networkstate"
+	"github.com/derlaft/w2wesher/p2p"
+	"github.com/derlaft/w2wesher/runnergroup"
+	"github.com/derlaft/w2wesher/wg"
+)
+
+// runCommand starts the daemon.
+func runCommand(overrides config.Overrides, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: run")
+	}
+
+	return run(overrides)
+}
+
+// run starts the daemon.
+func run(overrides config.Overrides) error {
+
+	err := notRoot()
+	if err != nil {
+		return err
+	}
+
+	state := networkstate.New()
+
+	cfg, err := config.Load(*configFile, *stateFile, overrides)
+	if err != nil {
+		return err
+	}
+
+	if *printEffectiveConfig {
+		return cfg.WriteEffective(os.Stdout)
+	}
+
+	err = cfg.Log.Apply()
+	if err != nil {
+		return err
+	}
+
+	var (
+		backend  wg.Backend
+		recorder control.DryRun
+	)
+	if *dryRun {
+		r, err := wg.NewRecorder()
+		if err != nil {
+			return err
+		}
+		log.Warn("dry-run mode: wireguard changes are only recorded, see the plan command")
+		backend, recorder = r, r
+	} else {
+		backend, err = wg.NewBackend()
+		if err != nil {
+			return err
+		}
+	}
+
+	adapter, err := wg.New(cfg, state, backend)
+	if err != nil {
+		return err
+	}
+
+	node, err := p2p.New(cfg, state, adapter)
+	if err != nil {
+		return err
+	}
+
+	ctl := control.New(cfg, state, node, adapter, recorder)
+
+	// fails if another instance is running
+	err = ctl.Listen()
+	if err != nil {
+		return err
+	}
+
+	reload := func(ctx context.Context) {
+		log.Info("reloading configuration")
+
+		updated, err := config.Load(*configFile, *stateFile, overrides)
+		if err != nil {
+			log.
+				With("err", err).
+				Error("reload failed, keeping the old configuration")
+			return
+		}
+
+		for _, change := range config.Diff(cfg, updated) {
+			if change.Live {
+				log.With("key", change).Info("applying changed setting")
+			} else {
+				log.With("key", change).Warn("changed setting can not be applied live, restart required")
+			}
+		}
+
+		// the settings requiring a restart are not applied partially
+		live := config.Live(cfg, updated)
+
+		err = live.Log.Apply()
+		if err != nil {
+			log.
+				With("err", err).
+				Error("could not apply log level")
+		}
+
+		node.Reload(ctx, live)
+		adapter.Reload(ctx, live)
+		ctl.Reload(ctx, live)
+		cfg = live
+	}
+
+	return runnergroup.New(context.TODO()).
+		Go(node.Run).
+		Go(adapter.Run).
+		Go(ctl.Run).
+		Go(runnergroup.AbortOnSignal).
+		Go(runnergroup.OnSignal(reload, syscall.SIGHUP)).
+		Wait()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/derlaft/w2wesher/config"
+)
+
+// showConfigCommand prints the merged configuration without touching the config and the state files.
+func showConfigCommand(overrides config.Overrides, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: show-config")
+	}
+
+	cfg, err := config.LoadReadOnly(*configFile, *stateFile, overrides)
+	if err != nil {
+		return err
+	}
+
+	return cfg.WriteEffective(os.Stdout)
+}
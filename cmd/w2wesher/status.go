@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/control"
+)
+
+// statusCommand prints this node and the merged view of all the peers.
+func statusCommand(overrides config.Overrides, args []string) error {
+	return printStatus(overrides, "status", args, true)
+}
+
+// peersCommand prints the merged view of all the peers only.
+func peersCommand(overrides config.Overrides, args []string) error {
+	return printStatus(overrides, "peers", args, false)
+}
+
+func printStatus(overrides config.Overrides, name string, args []string, self bool) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	_ = fs.Parse(args)
+
+	client, err := controlClient(overrides)
+	if err != nil {
+		return err
+	}
+
+	status, err := client.Status(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if self {
+			return enc.Encode(status)
+		}
+		return enc.Encode(status.Peers)
+	}
+
+	if self {
+		fmt.Printf("node:      %s (%s)\n", status.NodeName, status.PeerID)
+		fmt.Printf("interface: %s (%s)\n", status.Interface, status.WireguardPublicKey)
+		fmt.Printf("address:   %s (%s)\n", joinNonEmpty(status.OverlayAddr, status.OverlayAddr4), status.Claim)
+		if status.AutoMTU {
+			fmt.Printf("mtu:       %d (auto)\n", status.MTU)
+		} else {
+			fmt.Printf("mtu:       %d\n", status.MTU)
+		}
+		if len(status.Routes) > 0 {
+			fmt.Printf("routes:    %s\n", strings.Join(status.Routes, ", "))
+		}
+		if status.ExitNode != "" {
+			state := "not available"
+			if status.ExitNodeActive {
+				state = "active"
+			}
+			fmt.Printf("exit node: %s (%s)\n", shortID(status.ExitNode), state)
+		}
+		if status.DeviceError != "" {
+			fmt.Printf("device:    %s\n", status.DeviceError)
+		}
+		for _, c := range status.Conflicts {
+			var losers []string
+			for _, id := range c.Losers {
+				losers = append(losers, shortID(id))
+			}
+			if c.Winner == "" {
+				fmt.Printf("conflict:  %s pinned by %s, kept by nobody\n",
+					c.Addr, strings.Join(losers, ","))
+				continue
+			}
+			fmt.Printf("conflict:  %s kept by %s, lost by %s\n",
+				c.Addr, shortID(c.Winner), strings.Join(losers, ","))
+		}
+		for _, c := range status.RouteConflicts {
+			fmt.Printf("conflict:  route %s of %s overlaps %s of %s\n",
+				c.Route, shortID(c.Peer), c.Overlaps, shortID(c.Winner))
+		}
+		fmt.Println()
+	}
+
+	return writePeerTable(os.Stdout, status.Peers)
+}
+
+// controlClient connects to the control socket of the running daemon.
+func controlClient(overrides config.Overrides) (*control.Client, error) {
+	c, err := config.LoadControl(*configFile, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	return control.NewClient(c.Socket), nil
+}
+
+func writePeerTable(out io.Writer, peers []control.PeerStatus) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tOVERLAY\tENDPOINT\tP2P\tHANDSHAKE\tRX\tTX\tFLAGS")
+
+	for _, p := range peers {
+		p2p := "-"
+		if p.Connected {
+			p2p = fmt.Sprintf("%d conn", p.Connections)
+		}
+
+		handshake := "never"
+		if !p.LastHandshake.IsZero() {
+			handshake = time.Since(p.LastHandshake).Truncate(time.Second).String() + " ago"
+		}
+
+		flags := strings.Join(p.Flags, ",")
+		if flags == "" {
+			flags = "ok"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			shortID(p.ID),
+			orDash(joinNonEmpty(p.OverlayAddr, p.OverlayAddr4)),
+			orDash(p.Endpoint),
+			p2p,
+			handshake,
+			formatBytes(p.ReceiveBytes),
+			formatBytes(p.TransmitBytes),
+			flags,
+		)
+	}
+
+	return w.Flush()
+}
+
+// joinNonEmpty joins the values which are set.
+func joinNonEmpty(values ...string) string {
+	var set []string
+	for _, v := range values {
+		if v != "" {
+			set = append(set, v)
+		}
+	}
+	return strings.Join(set, ",")
+}
+
+// shortID keeps the tail of the peer ID: the prefix is the same for all ed25519 keys.
+func shortID(id string) string {
+	const keep = 8
+	if len(id) <= keep {
+		return id
+	}
+	return "…" + id[len(id)-keep:]
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/derlaft/w2wesher/config"
+)
+
+// version is set on build with -ldflags "-X main.version=..."
+var version = ""
+
+// versionCommand prints the build version.
+func versionCommand(overrides config.Overrides, args []string) error {
+	v := version
+	if v == "" {
+		v = "(devel)"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			v = info.Main.Version
+			for _, s := range info.Settings {
+				if s.Key == "vcs.revision" {
+					v += " " + s.Value
+				}
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(os.Stdout, "w2wesher %s (config version %d, %s)\n", v, config.CurrentVersion, runtime.Version())
+	return err
+}
@@ -1,13 +1,17 @@
 package config
 
 import (
-	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -22,32 +26,59 @@ var log = logging.Logger("w2wesher")
 
 var validate = validator.New()
 
-// TODO: validate config on load
 type Config struct {
-	filename  string `ini:"-"`
+	filename string `ini:"-"`
+	// state is the machine-managed part of the configuration
+	state *State `ini:"-"`
+	// lines maps keys to the line numbers for the error reporting
+	lines map[string]int `ini:"-"`
+	// readOnly configs never generate the missing keys, see LoadReadOnly
+	readOnly bool `ini:"-"`
+	// Version of the config layout, see CurrentVersion.
+	// Older configs are migrated automatically on start.
+	Version   int
 	P2P       P2P
 	Wireguard Wireguard
+	Control   Control
+	Log       Log
+	// StaticPeers are mapped from the [StaticPeer.<name>] sections
+	StaticPeers []StaticPeer `ini:"-"`
 }
 
 const (
-	DefaultP2PListenAddr       = "/ip4/0.0.0.0/udp/10042"
+	DefaultP2PListenAddr       = "/ip4/0.0.0.0/udp/10042/quic"
 	DefaultP2PAnnounceInterval = time.Minute
 )
 
 type P2P struct {
 	// Network PSK
-	// If not present, will be generated.
-	// TODO: find a nice way of configuring PSK?
-	PSK string `validate:"base64"`
+	// If not present, will be generated and stored in the state file.
+	PSK string
+	// PSKFile is a path to the file containing PSK.
+	PSKFile string
+	// NextPSK is the PSK the whole network is going to be rotated to.
+	// It is distributed to all the nodes by this node.
+	NextPSK string
+	// NextPSKFile is a path to the file containing NextPSK.
+	NextPSKFile string
+	// NextPSKActivation is the time of the switch to NextPSK in RFC3339 format.
+	NextPSKActivation string
+	// RotationSigners lists the peer IDs allowed to start the PSK rotation.
+	// The rotations announced by the other nodes are refused if empty.
+	RotationSigners []string
+	// configuredPSK is the PSK before applying the completed rotation
+	configuredPSK string
 	// PrivateKey encoded in base64
-	// If not present, will be generated.
-	PrivateKey string `validate:"base64"`
-	// List of Bootstrap nodes
+	// If not present, will be generated and stored in the state file.
+	PrivateKey string
+	// PrivateKeyFile is a path to the file containing PrivateKey.
+	PrivateKeyFile string
+	// List of static Bootstrap nodes
 	// Each node is a multiaddr, containing
-	// * the last known peer addr
-	// * the last known peer ID
+	// * the peer addr
+	// * the peer ID
 	// Might be empty on start.
-	// Will be periodically updated in runtime.
+	// Peers learned in runtime are stored in the state file.
 	Bootstrap []string
 	// ListenAddr is a libp2p multiaddr
 	ListenAddr       string
@@ -60,190 +91,376 @@ const (
 	DefaultWgNetworkRange        = "fd6d:142e:65e7:4cc1::/64"
 	DefaultWgListenPort          = 10043
 	DefaultWgPersistentKeepalive = time.Minute
+	DefaultWgMTU                 = 1420
+	DefaultWgLeaseExpiry         = 7 * 24 * time.Hour
+	DefaultWgPeerTTL             = 7 * 24 * time.Hour
+	// ExitNodeOff selected via the control socket disables the exit node set in the config.
+	ExitNodeOff = "off"
+	// MinPresharedKeyRotation limits how often the derived preshared keys are rotated.
+	MinPresharedKeyRotation = time.Hour
+	// MTUAuto makes the interface MTU follow the smallest working path to the peers.
+	MTUAuto = "auto"
+	// Limits of the fixed MTU
+	MinWgMTU = 1280
+	MaxWgMTU = 65535
 )
 
 type Wireguard struct {
 	// Wireguard interface name.
-	Interface string
+	Interface string `validate:"max=15"`
 	// PrivateKey encoded in base64.
-	// If not present, will be generated.
-	PrivateKey string `validate:"base64"`
+	// If not present, will be generated and stored in the state file.
+	PrivateKey string
+	// PrivateKeyFile is a path to the file containing PrivateKey.
+	PrivateKeyFile string
 	// Wireguard listen port.
-	ListenPort int
+	ListenPort int `validate:"max=65535"`
 	// NetworkRange to use.
-	NetworkRange string `validate:"cidr"`
+	NetworkRange string
+	// NetworkRange4 is an optional IPv4 range used in addition to the IPv6 NetworkRange.
+	NetworkRange4 string
+	// Address pins the overlay address of this node instead of leasing one.
+	Address string
+	// Address4 pins the IPv4 overlay address, NetworkRange4 is required.
+	Address4 string
+	// LeaseExpiry frees the leased addresses of the nodes not seen for that long.
+	LeaseExpiry time.Duration
+	// Routes are the prefixes behind this node announced to the mesh.
+	Routes []string
+	// AcceptRoutes limits the routes accepted from the other nodes to these prefixes.
+	// All the announced routes are accepted if empty.
+	AcceptRoutes []string
+	// ExitNode announces this node as an exit node for the internet traffic of the others.
+	ExitNode bool
+	// ExitNodeMasquerade enables forwarding and masquerades the traffic of the overlay networks.
+	ExitNodeMasquerade bool
+	// UseExitNode is the peer ID of the exit node all the internet traffic is routed through.
+	UseExitNode string
+	// PresharedKeyRotation rotates the preshared keys derived from the network PSK.
+	// Set to 0 to disable.
+	PresharedKeyRotation time.Duration
+	// PeerTTL removes the peers not seen for that long, neither announced nor handshaked.
+	// Set to -1 to disable.
+	PeerTTL time.Duration
 	// NodeName is a network hostname will be used for generating the addr.
-	// If not present, will be replaced with a hostname on the first time.
+	// If not present, the hostname on the first start is stored in the state file.
 	NodeName string `validate:"hostname"`
 	// Wireguard PersistentKeepalive setting.
 	// Set to -1 to disable.
 	PersistentKeepalive time.Duration
+	// MTU of the interface, a number or "auto".
+	MTU string
+	// KeyRotationInterval enables the automatic PrivateKey rotation.
+	// Set to 0 to disable.
+	KeyRotationInterval time.Duration
+	// configuredPrivateKey is the PrivateKey before applying the completed rotation
+	configuredPrivateKey string
+}
+
+// DefaultControlSocketName is the name of the control socket
+// created next to the config file by default.
+const DefaultControlSocketName = "control.sock"
+
+type Control struct {
+	// Socket is the path of the unix socket serving the control API.
+	// Defaults to control.sock next to the config file.
+	Socket string
+	// Group allowed to use the control socket.
+	// If not present, only the user running w2wesher can use it.
+	Group string
+}
+
+type Log struct {
+	// Level of the w2wesher loggers (debug, info, warn, error).
+	// If not present, GOLOG_LOG_LEVEL environment variable is respected.
+	Level string
+}
+
+// Load reads the config file and the state file and applies the overrides.
+// The config file is never modified, except for the migrations.
+func Load(filename, stateFilename string, overrides Overrides) (*Config, error) {
+	return load(filename, stateFilename, overrides, false)
+}
+
+// LoadReadOnly reads the config like Load, but never writes anything:
+// the config file must exist, the migrations are applied in memory only
+// and the keys missing from both the config and the state are left empty, see Missing.
+func LoadReadOnly(filename, stateFilename string, overrides Overrides) (*Config, error) {
+	return load(filename, stateFilename, overrides, true)
 }
 
-func Load(filename string) (*Config, error) {
+func load(filename, stateFilename string, overrides Overrides, readOnly bool) (*Config, error) {
 
-	cfg, err := ini.Load(filename)
-	if os.IsNotExist(err) {
-		cfg = ini.Empty()
-	} else if err != nil {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && (readOnly || !os.IsNotExist(err)) {
+		return nil, fmt.Errorf("config: cannot read config: %w", err)
+	}
+
+	cfg, err := ini.Load(data)
+	if err != nil {
 		return nil, fmt.Errorf("config: cannot parse ini: %w", err)
 	}
 
+	state, err := LoadState(stateFilename)
+	if err != nil {
+		return nil, err
+	}
+	state.readOnly = readOnly
+
+	migrated, err := migrate(cfg, filename, state, !readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	if migrated {
+		// line numbers might have changed
+		data, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("config: cannot read config: %w", err)
+		}
+	}
+
 	// Load config from disk
 	var parsed = new(Config)
 	parsed.filename = filename
+	parsed.lines = keyLines(data)
+	parsed.state = state
+	parsed.readOnly = readOnly
+
+	// Overridden values are not coming from the config file
+	overrides.apply(cfg)
+	for key := range overrides {
+		delete(parsed.lines, key)
+	}
 
 	err = cfg.MapTo(parsed)
 	if err != nil {
 		return nil, fmt.Errorf("config: cannot map ini: %w", err)
 	}
 
+	parsed.StaticPeers, err = loadStaticPeers(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	// Load secrets from files, credentials and environment
+	err = parsed.loadSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("config: loading secrets: %w", err)
+	}
+
 	// Apply defaults, generate keys
 	changed, err := parsed.Load()
 	if err != nil {
 		return nil, fmt.Errorf("config: load config: %w", err)
 	}
 
-	// Save back to disk if changed
-	if changed {
-		err := parsed.Save()
+	err = parsed.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	// Save generated values to the state file
+	if !readOnly && (changed || !state.existed) {
+		err := state.Save()
 		if err != nil {
-			return nil, fmt.Errorf("config: saving failed: %w", err)
+			return nil, fmt.Errorf("config: saving state failed: %w", err)
 		}
 	}
 
 	return parsed, nil
 }
 
-func (c *Config) Save() error {
-	cfg := ini.Empty()
-	err := ini.ReflectFrom(cfg, c)
-	if err != nil {
-		return err
-	}
-
-	var buf = bytes.NewBuffer(nil)
-	_, err = cfg.WriteTo(buf)
-	if err != nil {
-		return err
-	}
+// State returns the machine-managed part of the configuration.
+func (c *Config) State() *State {
+	return c.state
+}
 
-	err = ioutil.WriteFile(c.filename, buf.Bytes(), 0600)
-	if err != nil {
-		return err
+// Missing lists the keys which are generated on the first start of the daemon,
+// but are not set yet. Only the configs loaded with LoadReadOnly miss them.
+func (c *Config) Missing() []string {
+	var missing []string
+	for _, s := range c.secrets() {
+		if s.generated && *s.value == "" {
+			missing = append(missing, s.section+"."+s.key)
+		}
 	}
+	return missing
+}
 
-	return nil
+// StateExists reports whether the state file has been written already.
+func (c *Config) StateExists() bool {
+	return c.state.existed
 }
 
+// Load applies defaults. Generated values are stored in the state,
+// true is returned if the state has changed.
 func (c *Config) Load() (bool, error) {
-	p2pChanged, err := c.P2P.Load()
+	if c.Version == 0 {
+		c.Version = CurrentVersion
+	}
+
+	p2pChanged, err := c.P2P.Load(&c.state.P2P, !c.readOnly)
 	if err != nil {
 		return false, err
 	}
 
-	wgChanged, err := c.Wireguard.Load()
+	wgChanged, err := c.Wireguard.Load(&c.state.Wireguard, !c.readOnly)
 	if err != nil {
 		return false, err
 	}
 
+	c.Control.Load(c.filename)
+
 	return p2pChanged || wgChanged, nil
 }
 
-func (p *P2P) Load() (bool, error) {
+// Load applies the defaults, the missing keys are generated if requested.
+func (p *P2P) Load(state *StateP2P, generate bool) (bool, error) {
 	var changed bool
 
-	if p.PSK == "" {
-		err := p.GeneratePsk()
+	if p.PSK == "" && state.PSK == "" && generate {
+		psk, err := GeneratePsk()
 		if err != nil {
-			return false, nil
+			return false, fmt.Errorf("generating psk: %w", err)
 		}
+		state.PSK = psk
 		changed = true
 	}
 
-	if p.PrivateKey == "" {
-		err := p.GeneratePrivateKey()
+	if p.PSK == "" {
+		p.PSK = state.PSK
+	}
+
+	// apply the rotation which has happened while the node was down
+	p.configuredPSK = p.PSK
+	if state.NextPSK != "" && state.NextPSKActivation <= time.Now().Unix() {
+		state.completeRotation(p.configuredPSK)
+		changed = true
+	}
+
+	// the rotated PSK is used until the config is updated by the operator
+	if state.RotatedPSK != "" && state.RotatedFrom == Fingerprint(p.configuredPSK) {
+		p.PSK = state.RotatedPSK
+	}
+
+	if p.PrivateKey == "" && state.PrivateKey == "" && generate {
+		privateKey, err := GenerateP2PPrivateKey()
 		if err != nil {
-			return false, nil
+			return false, fmt.Errorf("generating p2p private key: %w", err)
 		}
+		state.PrivateKey = privateKey
 		changed = true
 	}
 
+	if p.PrivateKey == "" {
+		p.PrivateKey = state.PrivateKey
+	}
+
 	if p.ListenAddr == "" {
 		p.ListenAddr = DefaultP2PListenAddr
-		changed = true
 	}
 
 	if p.AnnounceInterval == 0 {
 		p.AnnounceInterval = DefaultP2PAnnounceInterval
-		changed = true
 	}
 
 	// make sure bootstrap addr list is always sorted
 	sort.Strings(p.Bootstrap)
 
-	err := validate.Struct(p)
-	if err != nil {
-		return false, err
-	}
-
 	return changed, nil
 }
 
-func (w *Wireguard) Load() (bool, error) {
+// Load applies the defaults, the missing keys are generated if requested.
+func (w *Wireguard) Load(state *StateWireguard, generate bool) (bool, error) {
 
 	var changed bool
 
 	if w.Interface == "" {
-		w.Interface = "wesh0"
-		changed = true
+		w.Interface = DefaultWgInterface
 	}
 
-	if w.PrivateKey == "" {
-		err := w.GeneratePrivateKey()
+	if w.PrivateKey == "" && state.PrivateKey == "" && generate {
+		privateKey, err := GenerateWireguardPrivateKey()
 		if err != nil {
-			return false, err
+			return false, fmt.Errorf("generating wireguard private key: %w", err)
 		}
+		state.PrivateKey = privateKey
+		changed = true
+	}
+
+	if w.PrivateKey == "" {
+		w.PrivateKey = state.PrivateKey
+	}
+
+	// apply the rotation which has happened while the node was down
+	w.configuredPrivateKey = w.PrivateKey
+	if state.NextPrivateKey != "" && state.NextKeyActivation <= time.Now().Unix() {
+		state.completeRotation(w.configuredPrivateKey)
+		changed = true
+	}
+
+	// the rotated key is used until the config is updated by the operator
+	if state.RotatedPrivateKey != "" && state.RotatedFrom == Fingerprint(w.configuredPrivateKey) {
+		w.PrivateKey = state.RotatedPrivateKey
+	}
+
+	if state.LastKeyRotation == 0 {
+		// the automatic rotation is counted from the first start
+		state.LastKeyRotation = time.Now().Unix()
 		changed = true
 	}
 
 	if w.ListenPort <= 0 {
 		w.ListenPort = DefaultWgListenPort
-		changed = true
+	}
+
+	if w.MTU == "" {
+		w.MTU = strconv.Itoa(DefaultWgMTU)
+	}
+
+	if w.LeaseExpiry == 0 {
+		w.LeaseExpiry = DefaultWgLeaseExpiry
+	}
+
+	if w.PeerTTL == 0 {
+		w.PeerTTL = DefaultWgPeerTTL
 	}
 
 	if w.NetworkRange == "" {
 		w.NetworkRange = DefaultWgNetworkRange
-		changed = true
 	}
 
-	if w.NodeName == "" {
+	if w.NodeName == "" && state.NodeName == "" {
 		// retrieve this data from the hostname
-		w.NodeName, _ = os.Hostname()
+		state.NodeName, _ = os.Hostname()
 		changed = true
 	}
 
-	if w.PersistentKeepalive == 0 {
-		w.PersistentKeepalive = DefaultWgPersistentKeepalive
-		changed = true
+	if w.NodeName == "" {
+		w.NodeName = state.NodeName
 	}
 
-	err := validate.Struct(w)
-	if err != nil {
-		return false, err
+	if w.PersistentKeepalive == 0 {
+		w.PersistentKeepalive = DefaultWgPersistentKeepalive
 	}
 
 	return changed, nil
 }
 
-func (w *Wireguard) GeneratePrivateKey() error {
+func (c *Control) Load(configFilename string) {
+	if c.Socket == "" {
+		c.Socket = filepath.Join(filepath.Dir(configFilename), DefaultControlSocketName)
+	}
+}
+
+// GenerateWireguardPrivateKey generates a new base64-encoded wireguard key.
+func GenerateWireguardPrivateKey() (string, error) {
 	private, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	w.PrivateKey = private.String()
-	return nil
+	return private.String(), nil
 }
 
 func (p *P2P) LoadPrivateKey() (crypto.PrivKey, error) {
@@ -261,42 +478,135 @@ func (p *P2P) LoadPrivateKey() (crypto.PrivKey, error) {
 	return privateKey, nil
 }
 
-func (p *P2P) GeneratePrivateKey() error {
+// GenerateP2PPrivateKey generates a new base64-encoded libp2p key.
+func GenerateP2PPrivateKey() (string, error) {
 
 	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	privateKey, err := crypto.MarshalPrivateKey(key)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	p.PrivateKey = base64.StdEncoding.EncodeToString(privateKey)
-
-	return nil
+	return base64.StdEncoding.EncodeToString(privateKey), nil
 }
 
 func (p *P2P) LoadPsk() ([]byte, error) {
 	return base64.StdEncoding.DecodeString(p.PSK)
 }
 
-func (p *P2P) GeneratePsk() error {
-	var d = make([]byte, 32)
+// ParseMTU returns the fixed MTU, or auto if it has to be discovered.
+func (w *Wireguard) ParseMTU() (mtu int, auto bool, err error) {
+	if w.MTU == MTUAuto {
+		return 0, true, nil
+	}
+
+	mtu, err = strconv.Atoi(w.MTU)
+	if err != nil {
+		return 0, false, fmt.Errorf("expected a number or %q", MTUAuto)
+	}
+
+	if mtu < MinWgMTU || mtu > MaxWgMTU {
+		return 0, false, fmt.Errorf("must be between %d and %d", MinWgMTU, MaxWgMTU)
+	}
+
+	return mtu, false, nil
+}
+
+// ParseRoutes returns the prefixes announced by this node.
+func (w *Wireguard) ParseRoutes() ([]netip.Prefix, error) {
+	return parsePrefixes(w.Routes)
+}
+
+// ParseAcceptRoutes returns the prefixes accepted from the other nodes.
+func (w *Wireguard) ParseAcceptRoutes() ([]netip.Prefix, error) {
+	return parsePrefixes(w.AcceptRoutes)
+}
+
+// ExitNode returns the peer ID of the exit node in use: the one selected
+// via the control socket or the configured one, empty if none.
+func (c *Config) ExitNode() string {
+	switch selected := c.state.ExitNode(); selected {
+	case "":
+		return c.Wireguard.UseExitNode
+	case ExitNodeOff:
+		return ""
+	default:
+		return selected
+	}
+}
+
+// NextPSKActivationTime parses NextPSKActivation.
+func (p *P2P) NextPSKActivationTime() (time.Time, error) {
+	return time.Parse(time.RFC3339, p.NextPSKActivation)
+}
+
+// RotationSignerIDs parses RotationSigners.
+func (p *P2P) RotationSignerIDs() ([]peer.ID, error) {
+	ids := make([]peer.ID, 0, len(p.RotationSigners))
+	for i, raw := range p.RotationSigners {
+		id, err := peer.Decode(raw)
+		if err != nil {
+			return nil, fmt.Errorf("entry #%d %q: %w", i+1, raw, err)
+		}
+
+		// the signature is checked with the key embedded into the ID
+		_, err = id.ExtractPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("entry #%d %q: %w", i+1, raw, err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// CompletePSKRotation switches to the pending PSK.
+// The new PSK is used until the config is updated by the operator.
+func (c *Config) CompletePSKRotation() error {
+	c.state.lock.Lock()
+	defer c.state.lock.Unlock()
+
+	c.state.P2P.completeRotation(c.P2P.configuredPSK)
+	return c.state.save()
+}
+
+// CompleteWireguardKeyRotation switches to the pending wireguard key.
+// The new key is used until the config is updated by the operator.
+func (c *Config) CompleteWireguardKeyRotation() error {
+	c.state.lock.Lock()
+	defer c.state.lock.Unlock()
+
+	c.state.Wireguard.completeRotation(c.Wireguard.configuredPrivateKey)
+	return c.state.save()
+}
+
+// Fingerprint identifies the PSK without revealing it.
+func Fingerprint(psk string) string {
+	sum := sha256.Sum256([]byte(psk))
+	return hex.EncodeToString(sum[:8])
+}
+
+// GeneratePsk generates a new base64-encoded network PSK.
+func GeneratePsk() (string, error) {
+	var d = make([]byte, pskLength)
 	_, err := rand.Read(d)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	p.PSK = base64.StdEncoding.EncodeToString(d)
-	return nil
+	return base64.StdEncoding.EncodeToString(d), nil
 }
 
-func (p *P2P) LoadBootstrapPeers() ([]peer.AddrInfo, error) {
+// LoadBootstrapPeers returns both static and learned bootstrap peers.
+func (c *Config) LoadBootstrapPeers() ([]peer.AddrInfo, error) {
 
 	var bootstrap []peer.AddrInfo
-	for _, rawAddr := range p.Bootstrap {
+	for _, rawAddr := range append(c.state.Bootstrap(), c.P2P.Bootstrap...) {
 		addr, err := peer.AddrInfoFromString(rawAddr)
 		if err != nil {
 			return nil, fmt.Errorf("config: invalid bootstrap addr %v: %w", rawAddr, err)
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+// CurrentVersion is the version of the config layout written by this binary.
+const CurrentVersion = 2
+
+// migration upgrades the config document from the version
+// equal to its index in migrations to the next one.
+type migration func(doc *ini.File, state *State) error
+
+var migrations = []migration{
+	// 0 -> 1: learned bootstrap peers are kept in the state file, not in the config
+	migrateBootstrap,
+	// 1 -> 2: libp2p listens on udp with quic instead of the bare udp
+	migrateListenAddr,
+}
+
+// documentVersion returns the layout version of the config document.
+// A document without any keys is considered up to date.
+func documentVersion(doc *ini.File) (int, error) {
+	key, err := doc.Section(ini.DefaultSection).GetKey("Version")
+	if err != nil {
+		if isEmptyDocument(doc) {
+			return CurrentVersion, nil
+		}
+		return 0, nil
+	}
+
+	version, err := key.Int()
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid Version %q", key.String())
+	}
+
+	return version, nil
+}
+
+func isEmptyDocument(doc *ini.File) bool {
+	for _, section := range doc.Sections() {
+		if len(section.Keys()) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// migrate upgrades the config document to the current version.
+// The previous version of the file is kept as a backup.
+// Without write, the document is only upgraded in memory.
+// Configs created by a newer binary are refused.
+func migrate(doc *ini.File, filename string, state *State, write bool) (bool, error) {
+	version, err := documentVersion(doc)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case version > CurrentVersion:
+		return false, fmt.Errorf("%s has version %d, but only versions up to %d are supported: upgrade w2wesher",
+			filename, version, CurrentVersion)
+	case version == CurrentVersion:
+		return false, nil
+	}
+
+	for v := version; v < CurrentVersion; v++ {
+		err := migrations[v](doc, state)
+		if err != nil {
+			return false, fmt.Errorf("migrating from version %d: %w", v, err)
+		}
+	}
+
+	doc.Section(ini.DefaultSection).Key("Version").SetValue(fmt.Sprint(CurrentVersion))
+
+	if !write {
+		log.
+			With("config", filename).
+			With("from", version).
+			With("to", CurrentVersion).
+			Warn("the config file has an older version, it is migrated on the next start of the daemon")
+		return false, nil
+	}
+
+	err = writeDocument(doc, filename, true)
+	if err != nil {
+		return false, fmt.Errorf("saving migrated config: %w", err)
+	}
+
+	log.
+		With("config", filename).
+		With("from", version).
+		With("to", CurrentVersion).
+		Warn("migrated the config file, the previous version is kept as a backup")
+
+	return true, nil
+}
+
+// migrateBootstrap moves the bootstrap list, which used to be updated
+// by w2wesher itself, to the state file. The entries are merged with the ones
+// already learned. A read-only state is only updated in memory.
+func migrateBootstrap(doc *ini.File, state *State) error {
+	section := doc.Section("P2P")
+	if !section.HasKey("Bootstrap") {
+		return nil
+	}
+
+	for _, addr := range section.Key("Bootstrap").Strings(",") {
+		if !slices.Contains(state.P2P.Bootstrap, addr) {
+			state.P2P.Bootstrap = append(state.P2P.Bootstrap, addr)
+		}
+	}
+	sort.Strings(state.P2P.Bootstrap)
+
+	if state.readOnly {
+		section.DeleteKey("Bootstrap")
+		return nil
+	}
+
+	// the state is saved first, so the list is never lost
+	err := state.save()
+	if err != nil {
+		return err
+	}
+
+	section.DeleteKey("Bootstrap")
+
+	log.
+		With("state", state.filename).
+		Warn("migrated learned bootstrap peers from the config to the state file")
+
+	return nil
+}
+
+// migrateListenAddr adds the quic protocol to the udp listen addr:
+// the default of the older versions was /ip4/0.0.0.0/udp/10042, which libp2p
+// can not listen on without it. Custom udp addrs are changed the same way,
+// the tcp ones are kept as is.
+func migrateListenAddr(doc *ini.File, state *State) error {
+	key, err := doc.Section("P2P").GetKey("ListenAddr")
+	if err != nil {
+		// the current default is used
+		return nil
+	}
+
+	addr := strings.TrimSuffix(key.String(), "/")
+	if !strings.Contains(addr, "/udp/") || strings.Contains(addr, "/quic") {
+		return nil
+	}
+
+	key.SetValue(addr + "/quic")
+
+	log.
+		With("key", "P2P.ListenAddr").
+		With("from", addr).
+		With("to", key.String()).
+		Warn("migrated the config key")
+
+	return nil
+}
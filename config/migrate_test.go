@@ -0,0 +1,202 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		wantMigrated bool
+		wantErr      bool
+		// wantKeys are checked after the migration, empty value means a missing key
+		wantKeys map[string]string
+		// wantBootstrap is the list saved to the state file
+		wantBootstrap []string
+	}{
+		{
+			name:         "version 0 with the old default listen addr",
+			config:       "[P2P]\nBootstrap=/ip4/10.0.0.1/udp/10042/quic/p2p/12D3KooWLz2zKmHgx3p5z9oNp8kKjFDVHrxYZZ6kZ4HbnQ8LEMvx\nListenAddr=/ip4/0.0.0.0/udp/10042\n",
+			wantMigrated: true,
+			wantKeys: map[string]string{
+				"Version":        "2",
+				"P2P.Bootstrap":  "",
+				"P2P.ListenAddr": "/ip4/0.0.0.0/udp/10042/quic",
+			},
+			wantBootstrap: []string{"/ip4/10.0.0.1/udp/10042/quic/p2p/12D3KooWLz2zKmHgx3p5z9oNp8kKjFDVHrxYZZ6kZ4HbnQ8LEMvx"},
+		},
+		{
+			name:         "version 1 with a custom udp listen addr",
+			config:       "Version=1\n[P2P]\nListenAddr=/ip6/::/udp/4242/\n",
+			wantMigrated: true,
+			wantKeys: map[string]string{
+				"Version":        "2",
+				"P2P.ListenAddr": "/ip6/::/udp/4242/quic",
+			},
+		},
+		{
+			name:         "version 1 with a tcp listen addr",
+			config:       "Version=1\n[P2P]\nListenAddr=/ip4/0.0.0.0/tcp/10042\n",
+			wantMigrated: true,
+			wantKeys: map[string]string{
+				"Version":        "2",
+				"P2P.ListenAddr": "/ip4/0.0.0.0/tcp/10042",
+			},
+		},
+		{
+			name:         "version 1 with the default listen addr",
+			config:       "Version=1\n[Wireguard]\nInterface=wg1\n",
+			wantMigrated: true,
+			wantKeys: map[string]string{
+				"Version":        "2",
+				"P2P.ListenAddr": "",
+			},
+		},
+		{
+			name:   "current version",
+			config: "Version=2\n[P2P]\nListenAddr=/ip4/0.0.0.0/udp/10042\n",
+			wantKeys: map[string]string{
+				"P2P.ListenAddr": "/ip4/0.0.0.0/udp/10042",
+			},
+		},
+		{
+			name:   "empty config",
+			config: "",
+			wantKeys: map[string]string{
+				"Version": "",
+			},
+		},
+		{
+			name:    "newer version",
+			config:  "Version=3\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid version",
+			config:  "Version=two\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "config.ini")
+			err := ioutil.WriteFile(filename, []byte(tt.config), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			doc, err := ini.Load(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stateFilename := filepath.Join(dir, "state.ini")
+			migrated, err := migrate(doc, filename, &State{filename: stateFilename}, true)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("migrate() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("migrate() error = %v", err)
+			}
+
+			if migrated != tt.wantMigrated {
+				t.Errorf("migrate() = %v, want %v", migrated, tt.wantMigrated)
+			}
+
+			// the written file is checked, not only the document
+			written, err := ini.Load(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for key, want := range tt.wantKeys {
+				section, name := ini.DefaultSection, key
+				if i := strings.Index(key, "."); i >= 0 {
+					section, name = key[:i], key[i+1:]
+				}
+
+				got := written.Section(section).Key(name).String()
+				if got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+
+			_, err = os.Stat(filename + backupSuffix)
+			if exists := err == nil; exists != tt.wantMigrated {
+				t.Errorf("backup exists = %v, want %v", exists, tt.wantMigrated)
+			}
+
+			// the saved state is checked as well
+			state, err := LoadState(stateFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(state.P2P.Bootstrap, tt.wantBootstrap) {
+				t.Errorf("state P2P.Bootstrap = %q, want %q", state.P2P.Bootstrap, tt.wantBootstrap)
+			}
+		})
+	}
+}
+
+// TestMigrateReadOnly makes sure the migrations are applied in memory only.
+func TestMigrateReadOnly(t *testing.T) {
+	const config = "Version=1\n[P2P]\nListenAddr=/ip4/0.0.0.0/udp/10042\n"
+
+	filename := filepath.Join(t.TempDir(), "config.ini")
+	err := ioutil.WriteFile(filename, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := ini.Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := migrate(doc, filename, &State{}, false)
+	if err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+
+	if migrated {
+		t.Error("migrate() = true, want false: nothing is written")
+	}
+
+	if got := doc.Section("P2P").Key("ListenAddr").String(); got != DefaultP2PListenAddr {
+		t.Errorf("P2P.ListenAddr = %q, want %q", got, DefaultP2PListenAddr)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != config {
+		t.Errorf("config file is changed:\n%s", data)
+	}
+
+	if _, err := os.Stat(filename + backupSuffix); !os.IsNotExist(err) {
+		t.Errorf("backup is written")
+	}
+}
+
+// TestMigrationsCoverAllVersions makes sure every version bump comes with a migration.
+func TestMigrationsCoverAllVersions(t *testing.T) {
+	if len(migrations) != CurrentVersion {
+		t.Errorf("%d migrations for CurrentVersion %d", len(migrations), CurrentVersion)
+	}
+}
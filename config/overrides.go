@@ -0,0 +1,115 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/ini.v1"
+)
+
+// redacted replaces the secrets in the printed config.
+const redacted = "<redacted>"
+
+// Overrides are the config values set outside of the config file,
+// keyed by "<section>.<key>".
+// They are applied on top of the config file, before defaults and validation.
+type Overrides map[string]string
+
+// EnvOverrides collects the overrides from W2WESHER_<SECTION>_<KEY> environment variables.
+func EnvOverrides() Overrides {
+	var o = make(Overrides)
+
+	for _, kv := range overridable() {
+		value, ok := os.LookupEnv(EnvName(kv.Section, kv.Key))
+		if ok {
+			o[kv.Section+"."+kv.Key] = value
+		}
+	}
+
+	return o
+}
+
+// RegisterFlags registers a -<section>.<key> flag for every config key.
+func (o Overrides) RegisterFlags(fs *flag.FlagSet) {
+	for _, kv := range overridable() {
+		name := kv.Section + "." + kv.Key
+		fs.Func(name, fmt.Sprintf("override [%s] %s (env %s)", kv.Section, kv.Key, EnvName(kv.Section, kv.Key)), func(value string) error {
+			o[name] = value
+			return nil
+		})
+	}
+}
+
+// overridable lists the keys which might be overridden:
+// all of them except for the config layout version.
+func overridable() []iniValue {
+	var keys []iniValue
+	for _, kv := range flatten(new(Config)) {
+		if kv.Section == ini.DefaultSection && kv.Key == "Version" {
+			continue
+		}
+		keys = append(keys, kv)
+	}
+
+	return keys
+}
+
+func (o Overrides) apply(file *ini.File) {
+	for _, kv := range overridable() {
+		value, ok := o[kv.Section+"."+kv.Key]
+		if ok {
+			file.Section(kv.Section).Key(kv.Key).SetValue(value)
+		}
+	}
+}
+
+// LoadControl reads only the control socket settings.
+// Unlike Load, it neither needs the secrets nor touches the state file,
+// so it can be used by the clients of the running daemon.
+func LoadControl(filename string, overrides Overrides) (*Control, error) {
+	file, err := ini.LooseLoad(filename)
+	if err != nil {
+		return nil, fmt.Errorf("config: cannot parse ini: %w", err)
+	}
+
+	overrides.apply(file)
+
+	var c Control
+	err = file.Section("Control").MapTo(&c)
+	if err != nil {
+		return nil, fmt.Errorf("config: cannot map ini: %w", err)
+	}
+
+	c.Load(filename)
+	return &c, nil
+}
+
+// WriteEffective writes the merged configuration in the ini format.
+// Secrets are redacted.
+func (c *Config) WriteEffective(w io.Writer) error {
+	var secrets = make(map[string]bool)
+	for _, s := range c.secrets() {
+		secrets[s.section+"."+s.key] = true
+	}
+
+	file := ini.Empty()
+	for _, kv := range flatten(c) {
+		if secrets[kv.Section+"."+kv.Key] && kv.Value != "" {
+			kv.Value = redacted
+		}
+		file.Section(kv.Section).Key(kv.Key).SetValue(kv.Value)
+	}
+
+	for _, p := range c.StaticPeers {
+		section := file.Section(staticPeerPrefix + p.Name)
+		err := section.ReflectFrom(&p)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := file.WriteTo(w)
+	return err
+}
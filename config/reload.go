@@ -0,0 +1,118 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// liveKeys lists the settings which can be applied without a restart.
+var liveKeys = map[string]bool{
+	"P2P.AnnounceInterval":           true,
+	"P2P.Bootstrap":                  true,
+	"P2P.NextPSK":                    true,
+	"P2P.NextPSKFile":                true,
+	"P2P.NextPSKActivation":          true,
+	"P2P.RotationSigners":            true,
+	"Wireguard.PersistentKeepalive":  true,
+	"Wireguard.KeyRotationInterval":  true,
+	"Wireguard.MTU":                  true,
+	"Wireguard.LeaseExpiry":          true,
+	"Wireguard.PeerTTL":              true,
+	"Wireguard.AcceptRoutes":         true,
+	"Wireguard.UseExitNode":          true,
+	"Wireguard.PresharedKeyRotation": true,
+	"Log.Level":                      true,
+}
+
+// Change describes a single changed setting.
+type Change struct {
+	Section string
+	Key     string
+	// Live is true if the change can be applied without a restart.
+	Live bool
+}
+
+func (c Change) String() string {
+	return c.Section + "." + c.Key
+}
+
+// Diff lists all the settings which differ between two configs.
+func Diff(old, updated *Config) []Change {
+	var (
+		changes []Change
+		ov      = reflect.ValueOf(old).Elem()
+		uv      = reflect.ValueOf(updated).Elem()
+	)
+
+	for i := 0; i < ov.NumField(); i++ {
+		section := ov.Type().Field(i)
+		if !section.IsExported() || section.Type.Kind() != reflect.Struct {
+			continue
+		}
+
+		for j := 0; j < section.Type.NumField(); j++ {
+			key := section.Type.Field(j)
+			if !key.IsExported() {
+				continue
+			}
+
+			if reflect.DeepEqual(ov.Field(i).Field(j).Interface(), uv.Field(i).Field(j).Interface()) {
+				continue
+			}
+
+			change := Change{
+				Section: section.Name,
+				Key:     key.Name,
+			}
+			change.Live = liveKeys[change.String()]
+			changes = append(changes, change)
+		}
+	}
+
+	// static peers are announced with the next announce
+	if !reflect.DeepEqual(old.StaticPeers, updated.StaticPeers) {
+		changes = append(changes, Change{
+			Section: strings.TrimSuffix(staticPeerPrefix, "."),
+			Key:     "*",
+			Live:    true,
+		})
+	}
+
+	return changes
+}
+
+// Live returns the updated config with only the live changes applied:
+// the settings requiring a restart keep their old values until then,
+// so the running daemon never mixes the old and the new ones.
+func Live(old, updated *Config) *Config {
+	var (
+		live = *updated
+		lv   = reflect.ValueOf(&live).Elem()
+		ov   = reflect.ValueOf(old).Elem()
+	)
+
+	for _, change := range Diff(old, updated) {
+		if change.Live {
+			continue
+		}
+
+		lv.FieldByName(change.Section).FieldByName(change.Key).Set(ov.FieldByName(change.Section).FieldByName(change.Key))
+	}
+
+	// the rotations are tracked against the configured secrets in use
+	live.P2P.configuredPSK = old.P2P.configuredPSK
+	live.Wireguard.configuredPrivateKey = old.Wireguard.configuredPrivateKey
+
+	return &live
+}
+
+// Apply sets the configured log level to all the w2wesher loggers.
+func (l *Log) Apply() error {
+	if l.Level == "" {
+		return nil
+	}
+
+	return logging.SetLogLevelRegex("^w2wesher", l.Level)
+}
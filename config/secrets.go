@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Secrets are loaded in the following order, the first one found wins:
+//  1. file configured with the *File key (e.g. PSKFile=);
+//  2. systemd credential in $CREDENTIALS_DIRECTORY (see LoadCredential=);
+//  3. W2WESHER_<SECTION>_<KEY> environment variable (see Overrides);
+//  4. inline value in the config file;
+//  5. value generated and stored in the state file.
+type secret struct {
+	section string
+	key     string
+	// file configured by the operator
+	file string
+	// systemd credential name
+	credential string
+	value      *string
+	// generated is true if the missing secret is generated on the first start
+	generated bool
+}
+
+func (c *Config) secrets() []secret {
+	return []secret{
+		{"P2P", "PSK", c.P2P.PSKFile, "p2p-psk", &c.P2P.PSK, true},
+		{"P2P", "NextPSK", c.P2P.NextPSKFile, "p2p-next-psk", &c.P2P.NextPSK, false},
+		{"P2P", "PrivateKey", c.P2P.PrivateKeyFile, "p2p-private-key", &c.P2P.PrivateKey, true},
+		{"Wireguard", "PrivateKey", c.Wireguard.PrivateKeyFile, "wireguard-private-key", &c.Wireguard.PrivateKey, true},
+	}
+}
+
+// loadSecrets replaces the inline secrets with the external ones.
+func (c *Config) loadSecrets() error {
+	v := validation{lines: c.lines}
+
+	for _, s := range c.secrets() {
+		value, err := s.load()
+		if err != nil {
+			v.add(s.section, s.key+"File", err)
+			continue
+		}
+
+		if value != "" {
+			*s.value = value
+		}
+	}
+
+	if len(v.errors) > 0 {
+		return &ValidationError{
+			Filename: c.filename,
+			Errors:   v.errors,
+		}
+	}
+
+	return nil
+}
+
+func (s *secret) load() (string, error) {
+	if s.file != "" {
+		return readSecretFile(s.file)
+	}
+
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		value, err := readSecretFile(filepath.Join(dir, s.credential))
+		if !os.IsNotExist(err) {
+			return value, err
+		}
+	}
+
+	// environment variables are already applied as overrides
+	return "", nil
+}
+
+// EnvName returns the name of the environment variable for the config key.
+func EnvName(section, key string) string {
+	return strings.ToUpper("W2WESHER_" + section + "_" + key)
+}
+
+// readSecretFile reads the secret making sure nobody else can read it.
+func readSecretFile(filename string) (string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", filename)
+	}
+
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return "", fmt.Errorf("%s is accessible by other users (mode %#o), must not be readable by group or others", filename, perm)
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() && st.Uid != 0 {
+		return "", fmt.Errorf("%s must be owned by the current user or root", filename)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", filename)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,363 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+// State is the machine-managed part of the configuration.
+// Unlike the config file, which is never modified by w2wesher in runtime,
+// the state file is owned by w2wesher and is rewritten when needed.
+type State struct {
+	filename string     `ini:"-"`
+	lock     sync.Mutex `ini:"-"`
+	// existed is false if the state file was just created
+	existed bool `ini:"-"`
+	// readOnly state is never saved, see LoadReadOnly
+	readOnly  bool `ini:"-"`
+	P2P       StateP2P
+	Wireguard StateWireguard
+}
+
+type StateP2P struct {
+	// Generated network PSK, used if not set in the config.
+	PSK string
+	// Generated PrivateKey, used if not set in the config.
+	PrivateKey string
+	// List of learned bootstrap nodes.
+	// Periodically updated in runtime.
+	Bootstrap []string
+	// Addrs of the running node, used when issuing invites.
+	Addrs []string
+	// Invite is a one-time-use invite token which is not redeemed yet.
+	Invite string
+	// RedeemedInvites lists invites issued by this node and already used,
+	// each one is "<nonce>/<expiration unix timestamp>".
+	RedeemedInvites []string
+	// NextPSK is the pending network PSK rotation.
+	NextPSK string
+	// NextPSKActivation is the unix time of the switch to NextPSK.
+	NextPSKActivation int64
+	// RotatedPSK is the PSK which replaced the configured one.
+	RotatedPSK string
+	// RotatedFrom is the fingerprint of the configured PSK replaced by RotatedPSK.
+	RotatedFrom string
+}
+
+type StateWireguard struct {
+	// Generated PrivateKey, used if not set in the config.
+	PrivateKey string
+	// NodeName remembered on the first start, used if not set in the config.
+	NodeName string
+	// NextPrivateKey is the pending key rotation.
+	NextPrivateKey string
+	// NextKeyActivation is the unix time of the switch to NextPrivateKey.
+	NextKeyActivation int64
+	// RotatedPrivateKey is the key which replaced the configured one.
+	RotatedPrivateKey string
+	// RotatedFrom is the fingerprint of the configured key replaced by RotatedPrivateKey.
+	RotatedFrom string
+	// LastKeyRotation is the unix time of the last key rotation
+	// (or the first start), used for the automatic rotation.
+	LastKeyRotation int64
+	// AddrSalt changes the overlay addresses of AddrSaltNode
+	// after losing an address conflict.
+	AddrSalt     int
+	AddrSaltNode string
+	// LeaseAddr and LeaseAddr4 are the overlay addresses leased by this node,
+	// LeaseRenewed is the unix time the lease was last renewed.
+	LeaseAddr    string
+	LeaseAddr4   string
+	LeaseRenewed int64
+	// ExitNode is the exit node selected via the control socket,
+	// it takes precedence over Wireguard.UseExitNode, see ExitNodeOff.
+	ExitNode string
+}
+
+// DefaultStateFile returns the state file path for the given config file.
+// The systemd StateDirectory is used if available.
+func DefaultStateFile(configFile string) string {
+	if dirs := os.Getenv("STATE_DIRECTORY"); dirs != "" {
+		return filepath.Join(strings.Split(dirs, ":")[0], "state.ini")
+	}
+
+	ext := filepath.Ext(configFile)
+	return strings.TrimSuffix(configFile, ext) + ".state" + ext
+}
+
+// LoadState loads the state file. A missing file is not an error.
+func LoadState(filename string) (*State, error) {
+	var state = &State{
+		filename: filename,
+	}
+
+	file, err := ini.Load(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("config: cannot parse state: %w", err)
+	}
+	state.existed = true
+
+	err = file.MapTo(state)
+	if err != nil {
+		return nil, fmt.Errorf("config: cannot map state: %w", err)
+	}
+
+	return state, nil
+}
+
+// UpdateBootstrap saves the list of learned bootstrap addrs if it was changed.
+func (s *State) UpdateBootstrap(addrs []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sort.Strings(addrs)
+	if slices.Equal(addrs, s.P2P.Bootstrap) {
+		return nil
+	}
+
+	s.P2P.Bootstrap = addrs
+	return s.save()
+}
+
+// UpdateAddrs saves the addrs of the running node if they were changed.
+func (s *State) UpdateAddrs(addrs []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sort.Strings(addrs)
+	if slices.Equal(addrs, s.P2P.Addrs) {
+		return nil
+	}
+
+	s.P2P.Addrs = addrs
+	return s.save()
+}
+
+// Addrs returns a copy of the addrs of the running node.
+func (s *State) Addrs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return slices.Clone(s.P2P.Addrs)
+}
+
+// PendingInvite returns the invite token which should be redeemed.
+func (s *State) PendingInvite() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.P2P.Invite
+}
+
+// SetPendingInvite saves the invite token which should be redeemed.
+func (s *State) SetPendingInvite(token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.P2P.Invite = token
+	return s.save()
+}
+
+// RedeemInvite marks the invite nonce as used.
+// Returns an error if it is already used.
+func (s *State) RedeemInvite(nonce string, expires int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var (
+		now       = time.Now().Unix()
+		redeemed  = []string{fmt.Sprintf("%s/%d", nonce, expires)}
+		duplicate bool
+	)
+
+	for _, entry := range s.P2P.RedeemedInvites {
+		var (
+			entryNonce   string
+			entryExpires int64
+		)
+		_, err := fmt.Sscanf(strings.Replace(entry, "/", " ", 1), "%s %d", &entryNonce, &entryExpires)
+		if err != nil {
+			// garbage
+			continue
+		}
+
+		if entryExpires > 0 && entryExpires < now {
+			// expired invites can not be used anyway
+			continue
+		}
+
+		duplicate = duplicate || entryNonce == nonce
+		redeemed = append(redeemed, entry)
+	}
+
+	if duplicate {
+		return fmt.Errorf("invite was already used")
+	}
+
+	s.P2P.RedeemedInvites = redeemed
+	return s.save()
+}
+
+// NextPSK returns the pending PSK rotation, if any.
+func (s *State) NextPSK() (string, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.P2P.NextPSK, time.Unix(s.P2P.NextPSKActivation, 0)
+}
+
+// SetNextPSK saves the pending PSK rotation.
+func (s *State) SetNextPSK(psk string, activation time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.P2P.NextPSK = psk
+	s.P2P.NextPSKActivation = activation.Unix()
+	return s.save()
+}
+
+func (s *StateP2P) completeRotation(configuredPSK string) {
+	s.RotatedFrom = Fingerprint(configuredPSK)
+	s.RotatedPSK = s.NextPSK
+	s.NextPSK = ""
+	s.NextPSKActivation = 0
+}
+
+// NextWireguardKey returns the pending wireguard key rotation, if any.
+func (s *State) NextWireguardKey() (string, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.Wireguard.NextPrivateKey, time.Unix(s.Wireguard.NextKeyActivation, 0)
+}
+
+// SetNextWireguardKey saves the pending wireguard key rotation.
+func (s *State) SetNextWireguardKey(key string, activation time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Wireguard.NextPrivateKey = key
+	s.Wireguard.NextKeyActivation = activation.Unix()
+	return s.save()
+}
+
+// LastWireguardKeyRotation returns the time of the last key rotation.
+func (s *State) LastWireguardKeyRotation() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return time.Unix(s.Wireguard.LastKeyRotation, 0)
+}
+
+// AddrSalt returns the salt of the overlay addresses chosen for the node name.
+func (s *State) AddrSalt(nodeName string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.Wireguard.AddrSaltNode != nodeName {
+		// chosen for another name, not relevant anymore
+		return 0
+	}
+
+	return s.Wireguard.AddrSalt
+}
+
+// SetAddrSalt saves the salt of the overlay addresses.
+func (s *State) SetAddrSalt(nodeName string, salt int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Wireguard.AddrSalt = salt
+	s.Wireguard.AddrSaltNode = nodeName
+	return s.save()
+}
+
+// ExitNode returns the exit node selected via the control socket,
+// empty if the config is followed.
+func (s *State) ExitNode() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.Wireguard.ExitNode
+}
+
+// SetExitNode saves the exit node selected via the control socket.
+func (s *State) SetExitNode(exitNode string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.Wireguard.ExitNode == exitNode {
+		return nil
+	}
+
+	s.Wireguard.ExitNode = exitNode
+	return s.save()
+}
+
+// Lease returns the overlay addresses leased by this node, if any.
+func (s *State) Lease() (addr, addr4 string, renewed time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.Wireguard.LeaseAddr, s.Wireguard.LeaseAddr4, time.Unix(s.Wireguard.LeaseRenewed, 0)
+}
+
+// SetLease saves the overlay addresses leased by this node,
+// empty addr drops the lease.
+func (s *State) SetLease(addr, addr4 string, renewed time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Wireguard.LeaseAddr = addr
+	s.Wireguard.LeaseAddr4 = addr4
+	s.Wireguard.LeaseRenewed = renewed.Unix()
+	return s.save()
+}
+
+func (s *StateWireguard) completeRotation(configuredKey string) {
+	s.RotatedFrom = Fingerprint(configuredKey)
+	s.RotatedPrivateKey = s.NextPrivateKey
+	s.NextPrivateKey = ""
+	s.NextKeyActivation = 0
+	s.LastKeyRotation = time.Now().Unix()
+}
+
+// Bootstrap returns a copy of the learned bootstrap addrs.
+func (s *State) Bootstrap() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return slices.Clone(s.P2P.Bootstrap)
+}
+
+// Save writes the state to the disk.
+func (s *State) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.save()
+}
+
+func (s *State) save() error {
+	if s.readOnly {
+		return fmt.Errorf("config: state %s is loaded read-only", s.filename)
+	}
+
+	err := saveIni(s.filename, s)
+	if err != nil {
+		return fmt.Errorf("config: saving state: %w", err)
+	}
+
+	s.existed = true
+	return nil
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/derlaft/w2wesher/networkstate"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/ini.v1"
+)
+
+// staticPeerPrefix starts the names of the static peer sections: [StaticPeer.<name>]
+const staticPeerPrefix = "StaticPeer."
+
+// StaticPeer is a plain wireguard device which can not run w2wesher.
+// It is announced into the mesh by this node.
+type StaticPeer struct {
+	// Name is taken from the section name
+	Name string `ini:"-"`
+	// PublicKey of the device encoded in base64
+	PublicKey string
+	// Endpoint of the device (host:port), optional:
+	// the device might connect to the mesh itself
+	Endpoint string
+	// Address of the device in the overlay network
+	Address string
+	// AllowedIPs routed to the device in addition to the Address
+	AllowedIPs []string
+}
+
+// loadStaticPeers maps all the [StaticPeer.<name>] sections, sorted by name.
+func loadStaticPeers(file *ini.File) ([]StaticPeer, error) {
+	var peers []StaticPeer
+
+	for _, section := range file.Sections() {
+		name := section.Name()
+		if !strings.HasPrefix(name, staticPeerPrefix) {
+			continue
+		}
+
+		p := StaticPeer{Name: strings.TrimPrefix(name, staticPeerPrefix)}
+		err := section.MapTo(&p)
+		if err != nil {
+			return nil, fmt.Errorf("mapping [%s]: %w", name, err)
+		}
+
+		peers = append(peers, p)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+
+	return peers, nil
+}
+
+// Prefixes returns the Address and the AllowedIPs of the peer.
+func (p *StaticPeer) Prefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	if p.Address != "" {
+		addr, err := netip.ParseAddr(p.Address)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	for _, raw := range p.AllowedIPs {
+		prefix, err := parsePrefixOrAddr(raw)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// parsePrefixOrAddr accepts both a CIDR and a single address.
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parsePrefixes parses the list of CIDRs or single addresses.
+func parsePrefixes(raw []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for i, r := range raw {
+		prefix, err := parsePrefixOrAddr(r)
+		if err != nil {
+			return nil, fmt.Errorf("entry #%d %q: %w", i+1, r, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// Announce returns the peer as announced into the mesh.
+func (p *StaticPeer) Announce() networkstate.StaticPeer {
+	sp := networkstate.StaticPeer{
+		Name:      p.Name,
+		PublicKey: p.PublicKey,
+		Endpoint:  p.Endpoint,
+	}
+
+	prefixes, _ := p.Prefixes()
+	for _, prefix := range prefixes {
+		sp.AllowedIPs = append(sp.AllowedIPs, prefix.String())
+	}
+
+	return sp
+}
+
+func (p *StaticPeer) validate(v *validation, networkRange string) {
+	section := staticPeerPrefix + p.Name
+
+	_, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		v.add(section, "PublicKey", err)
+	}
+
+	if p.Endpoint != "" {
+		_, port, err := net.SplitHostPort(p.Endpoint)
+		if err != nil {
+			v.add(section, "Endpoint", err)
+		} else if port == "" {
+			v.add(section, "Endpoint", fmt.Errorf("port is missing"))
+		}
+	}
+
+	if p.Address == "" && len(p.AllowedIPs) == 0 {
+		v.add(section, "Address", fmt.Errorf("either Address or AllowedIPs must be set"))
+	}
+
+	if p.Address != "" {
+		addr, err := netip.ParseAddr(p.Address)
+		if err != nil {
+			v.add(section, "Address", err)
+		} else if prefix, err := netip.ParsePrefix(networkRange); err == nil && !prefix.Contains(addr) {
+			v.add(section, "Address", fmt.Errorf("%s is outside of the network range %s", addr, prefix))
+		}
+	}
+
+	for i, raw := range p.AllowedIPs {
+		_, err := parsePrefixOrAddr(raw)
+		if err != nil {
+			v.add(section, "AllowedIPs", fmt.Errorf("entry #%d %q: %w", i+1, raw, err))
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/ini.v1"
+)
+
+// MinNetworkHostBits is the minimal amount of host bits the network range
+// must have: node addresses are derived from a hash, so a tiny range
+// would make collisions very likely.
+const MinNetworkHostBits = 16
+
+// MinNetworkHostBits4 is the same for the additional IPv4 range:
+// the legacy /24 networks are allowed, but collisions are likely with many nodes.
+const MinNetworkHostBits4 = 8
+
+// pskLength is the only PSK length supported by libp2p pnet.
+const pskLength = 32
+
+// FieldError describes a single problem with the configuration.
+type FieldError struct {
+	Section string
+	Key     string
+	// Line in the configuration file, 0 if unknown
+	Line int
+	Err  error
+}
+
+func (e FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: [%s] %s: %v", e.Line, e.Section, e.Key, e.Err)
+	}
+	return fmt.Sprintf("[%s] %s: %v", e.Section, e.Key, e.Err)
+}
+
+func (e FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError holds all the problems found in the configuration,
+// so they can be fixed at once.
+type ValidationError struct {
+	Filename string
+	Errors   []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d problem(s) found", e.Filename, len(e.Errors))
+	for _, fe := range e.Errors {
+		b.WriteString("\n\t")
+		b.WriteString(fe.Error())
+	}
+	return b.String()
+}
+
+type validation struct {
+	lines  map[string]int
+	errors []FieldError
+	// skip lists the keys which are not checked
+	skip map[string]bool
+}
+
+func (v *validation) add(section, key string, err error) {
+	if v.skip[section+"."+key] {
+		return
+	}
+
+	v.errors = append(v.errors, FieldError{
+		Section: section,
+		Key:     key,
+		Line:    v.lines[section+"."+key],
+		Err:     err,
+	})
+}
+
+// Validate checks the whole configuration semantically.
+// All the problems found are returned together as *ValidationError.
+func (c *Config) Validate() error {
+	v := validation{lines: c.lines, skip: make(map[string]bool)}
+
+	// not generated yet, see LoadReadOnly
+	for _, key := range c.Missing() {
+		v.skip[key] = true
+	}
+
+	err := validate.Struct(c)
+	var tagErrors validator.ValidationErrors
+	if errors.As(err, &tagErrors) {
+		for _, fe := range tagErrors {
+			// namespace is Config.<Section>.<Key> or Config.<Key>
+			section := ini.DefaultSection
+			if ns := strings.Split(fe.StructNamespace(), "."); len(ns) > 2 {
+				section = ns[len(ns)-2]
+			}
+			v.add(section, fe.StructField(), fmt.Errorf("failed %q check (value %q)", fe.Tag(), fe.Value()))
+		}
+	} else if err != nil {
+		return err
+	}
+
+	c.P2P.validate(&v)
+	c.Wireguard.validate(&v)
+	c.Control.validate(&v)
+
+	var keys = make(map[string]string)
+	for _, p := range c.StaticPeers {
+		p.validate(&v, c.Wireguard.NetworkRange)
+
+		if other, ok := keys[p.PublicKey]; ok {
+			v.add(staticPeerPrefix+p.Name, "PublicKey", fmt.Errorf("already used by [%s%s]", staticPeerPrefix, other))
+		}
+		keys[p.PublicKey] = p.Name
+	}
+	c.Log.validate(&v)
+
+	// wireguard always listens on udp: make sure libp2p does not use the same port
+	if port, ok := c.P2P.udpPort(); ok && port == c.Wireguard.ListenPort {
+		v.add("Wireguard", "ListenPort", fmt.Errorf("port %d is already used by P2P.ListenAddr", port))
+	}
+
+	if len(v.errors) > 0 {
+		return &ValidationError{
+			Filename: c.filename,
+			Errors:   v.errors,
+		}
+	}
+
+	return nil
+}
+
+func (p *P2P) validate(v *validation) {
+	psk, err := p.LoadPsk()
+	if err != nil {
+		v.add("P2P", "PSK", fmt.Errorf("invalid base64: %w", err))
+	} else if len(psk) != pskLength {
+		v.add("P2P", "PSK", fmt.Errorf("must be exactly %d bytes long, got %d", pskLength, len(psk)))
+	}
+
+	_, err = p.LoadPrivateKey()
+	if err != nil {
+		v.add("P2P", "PrivateKey", err)
+	}
+
+	if p.NextPSK != "" {
+		psk, err := base64.StdEncoding.DecodeString(p.NextPSK)
+		if err != nil {
+			v.add("P2P", "NextPSK", fmt.Errorf("invalid base64: %w", err))
+		} else if len(psk) != pskLength {
+			v.add("P2P", "NextPSK", fmt.Errorf("must be exactly %d bytes long, got %d", pskLength, len(psk)))
+		}
+
+		_, err = p.NextPSKActivationTime()
+		if err != nil {
+			v.add("P2P", "NextPSKActivation", err)
+		}
+	}
+
+	_, err = p.RotationSignerIDs()
+	if err != nil {
+		v.add("P2P", "RotationSigners", err)
+	}
+
+	for i, rawAddr := range p.Bootstrap {
+		_, err := peer.AddrInfoFromString(rawAddr)
+		if err != nil {
+			v.add("P2P", "Bootstrap", fmt.Errorf("entry #%d %q: %w", i+1, rawAddr, err))
+		}
+	}
+
+	_, err = multiaddr.NewMultiaddr(p.ListenAddr)
+	if err != nil {
+		v.add("P2P", "ListenAddr", err)
+	}
+
+	if p.AnnounceInterval < 0 {
+		v.add("P2P", "AnnounceInterval", fmt.Errorf("must be positive"))
+	}
+}
+
+// udpPort returns the udp port libp2p listens on, if any.
+func (p *P2P) udpPort() (int, bool) {
+	addr, err := multiaddr.NewMultiaddr(p.ListenAddr)
+	if err != nil {
+		return 0, false
+	}
+
+	value, err := addr.ValueForProtocol(multiaddr.P_UDP)
+	if err != nil {
+		return 0, false
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+
+	return port, true
+}
+
+func (w *Wireguard) validate(v *validation) {
+	_, err := wgtypes.ParseKey(w.PrivateKey)
+	if err != nil {
+		v.add("Wireguard", "PrivateKey", err)
+	}
+
+	if w.KeyRotationInterval < 0 {
+		v.add("Wireguard", "KeyRotationInterval", fmt.Errorf("must be positive"))
+	}
+
+	if w.PresharedKeyRotation < 0 {
+		v.add("Wireguard", "PresharedKeyRotation", fmt.Errorf("must be positive"))
+	} else if w.PresharedKeyRotation > 0 && w.PresharedKeyRotation < MinPresharedKeyRotation {
+		v.add("Wireguard", "PresharedKeyRotation", fmt.Errorf("must be at least %s", MinPresharedKeyRotation))
+	}
+
+	if _, _, err := w.ParseMTU(); err != nil {
+		v.add("Wireguard", "MTU", err)
+	}
+
+	prefix, err := netip.ParsePrefix(w.NetworkRange)
+	if err != nil {
+		v.add("Wireguard", "NetworkRange", err)
+	} else if hostBits := prefix.Addr().BitLen() - prefix.Bits(); hostBits < MinNetworkHostBits {
+		v.add("Wireguard", "NetworkRange", fmt.Errorf("has only %d host bits, at least %d are required for address assignment", hostBits, MinNetworkHostBits))
+	}
+
+	if w.LeaseExpiry < 0 {
+		v.add("Wireguard", "LeaseExpiry", fmt.Errorf("must be positive"))
+	}
+
+	routes, err := parsePrefixes(w.Routes)
+	if err != nil {
+		v.add("Wireguard", "Routes", err)
+	}
+
+	for _, route := range routes {
+		switch {
+		case route.Bits() == 0:
+			v.add("Wireguard", "Routes", fmt.Errorf("default route %s is not allowed", route))
+		case prefix.IsValid() && prefix.Overlaps(route):
+			v.add("Wireguard", "Routes", fmt.Errorf("%s overlaps NetworkRange %s", route, prefix))
+		}
+
+		if prefix4, err := netip.ParsePrefix(w.NetworkRange4); err == nil && prefix4.Overlaps(route) {
+			v.add("Wireguard", "Routes", fmt.Errorf("%s overlaps NetworkRange4 %s", route, prefix4))
+		}
+	}
+
+	if _, err := parsePrefixes(w.AcceptRoutes); err != nil {
+		v.add("Wireguard", "AcceptRoutes", err)
+	}
+
+	if w.UseExitNode != "" {
+		if _, err := peer.Decode(w.UseExitNode); err != nil {
+			v.add("Wireguard", "UseExitNode", err)
+		} else if w.NetworkRange4 == "" {
+			v.add("Wireguard", "UseExitNode", fmt.Errorf("requires NetworkRange4, otherwise the IPv4 traffic bypasses the exit node"))
+		}
+	}
+
+	if w.ExitNodeMasquerade && !w.ExitNode {
+		v.add("Wireguard", "ExitNodeMasquerade", fmt.Errorf("requires ExitNode"))
+	}
+
+	if w.Address != "" {
+		addr, err := netip.ParseAddr(w.Address)
+		switch {
+		case err != nil:
+			v.add("Wireguard", "Address", err)
+		case prefix.IsValid() && !prefix.Contains(addr):
+			v.add("Wireguard", "Address", fmt.Errorf("is not in NetworkRange %s", prefix))
+		}
+	}
+
+	if w.NetworkRange4 == "" {
+		if w.Address4 != "" {
+			v.add("Wireguard", "Address4", fmt.Errorf("requires NetworkRange4"))
+		}
+		return
+	}
+
+	if (w.Address == "") != (w.Address4 == "") {
+		v.add("Wireguard", "Address4", fmt.Errorf("pin both Address and Address4 or none of them"))
+	}
+
+	prefix4, err := netip.ParsePrefix(w.NetworkRange4)
+	switch {
+	case err != nil:
+		v.add("Wireguard", "NetworkRange4", err)
+	case !prefix4.Addr().Is4():
+		v.add("Wireguard", "NetworkRange4", fmt.Errorf("must be an IPv4 range"))
+	case 32-prefix4.Bits() < MinNetworkHostBits4:
+		v.add("Wireguard", "NetworkRange4", fmt.Errorf("has only %d host bits, at least %d are required for address assignment", 32-prefix4.Bits(), MinNetworkHostBits4))
+	case prefix.IsValid() && prefix.Addr().Is4():
+		v.add("Wireguard", "NetworkRange4", fmt.Errorf("NetworkRange is already IPv4"))
+	}
+
+	if w.Address4 != "" {
+		addr4, err := netip.ParseAddr(w.Address4)
+		switch {
+		case err != nil:
+			v.add("Wireguard", "Address4", err)
+		case prefix4.IsValid() && !prefix4.Contains(addr4):
+			v.add("Wireguard", "Address4", fmt.Errorf("is not in NetworkRange4 %s", prefix4))
+		}
+	}
+}
+
+func (c *Control) validate(v *validation) {
+	if c.Group == "" {
+		return
+	}
+
+	_, err := user.LookupGroup(c.Group)
+	if err != nil {
+		v.add("Control", "Group", err)
+	}
+}
+
+func (l *Log) validate(v *validation) {
+	if l.Level == "" {
+		return
+	}
+
+	_, err := logging.LevelFromString(l.Level)
+	if err != nil {
+		v.add("Log", "Level", err)
+	}
+}
+
+// keyLines maps "<section>.<key>" to the line the key is defined on.
+func keyLines(data []byte) map[string]int {
+	var (
+		lines   = make(map[string]int)
+		section = ini.DefaultSection
+	)
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "", line[0] == '#', line[0] == ';':
+			continue
+		case line[0] == '[':
+			end := strings.IndexByte(line, ']')
+			if end > 0 {
+				section = strings.TrimSpace(line[1:end])
+			}
+		default:
+			end := strings.IndexAny(line, "=:")
+			if end < 0 {
+				continue
+			}
+			key := section + "." + strings.TrimSpace(line[:end])
+			if _, ok := lines[key]; !ok {
+				lines[key] = i + 1
+			}
+		}
+	}
+
+	return lines
+}
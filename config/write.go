@@ -0,0 +1,259 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// backupSuffix is appended to the backup copy of the previous file version.
+const backupSuffix = ".bak"
+
+type iniValue struct {
+	Section string
+	Key     string
+	Value   string
+}
+
+// flatten lists all the values of the ini-mapped struct in the ini format.
+func flatten(v interface{}) []iniValue {
+	var (
+		values []iniValue
+		rv     = reflect.ValueOf(v).Elem()
+	)
+
+	var walk func(section string, rv reflect.Value)
+	walk = func(section string, rv reflect.Value) {
+		for i := 0; i < rv.NumField(); i++ {
+			field := rv.Type().Field(i)
+			if !field.IsExported() || field.Tag.Get("ini") == "-" {
+				continue
+			}
+
+			value := rv.Field(i)
+			switch {
+			case field.Type.Kind() == reflect.Struct:
+				walk(field.Name, value)
+			case field.Type == reflect.TypeOf(time.Duration(0)):
+				values = append(values, iniValue{section, field.Name, value.Interface().(time.Duration).String()})
+			case field.Type.Kind() == reflect.Slice:
+				var items []string
+				for j := 0; j < value.Len(); j++ {
+					items = append(items, fmt.Sprint(value.Index(j).Interface()))
+				}
+				values = append(values, iniValue{section, field.Name, strings.Join(items, ",")})
+			default:
+				values = append(values, iniValue{section, field.Name, fmt.Sprint(value.Interface())})
+			}
+		}
+	}
+	walk(ini.DefaultSection, rv)
+
+	return values
+}
+
+// loadDocument loads the ini file as is, including the comments.
+// A missing file results in an empty document.
+func loadDocument(filename string) (*ini.File, error) {
+	doc, err := ini.Load(filename)
+	if os.IsNotExist(err) {
+		return ini.Empty(), nil
+	}
+	return doc, err
+}
+
+// saveIni updates the state file with the values of the ini-mapped struct v.
+// Only the changed keys are modified in the original document:
+// comments, ordering and unknown keys are preserved.
+// The state is rewritten often, so no backup is kept.
+// The config file is only written by the migrations, Init and Join, see writeDocument.
+func saveIni(filename string, v interface{}) error {
+	doc, err := loadDocument(filename)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", filename, err)
+	}
+
+	// map the original document to compare the values semantically
+	// (e.g. 1m and 60s durations are the same)
+	original := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+	_ = doc.MapTo(original)
+
+	var originalValues = make(map[string]string)
+	for _, kv := range flatten(original) {
+		originalValues[kv.Section+"."+kv.Key] = kv.Value
+	}
+
+	for _, kv := range flatten(v) {
+		name := kv.Section + "." + kv.Key
+		if originalValues[name] == kv.Value {
+			continue
+		}
+		doc.Section(kv.Section).Key(kv.Key).SetValue(kv.Value)
+	}
+
+	return writeDocument(doc, filename, false)
+}
+
+// writeDocument writes the ini document to the disk atomically.
+func writeDocument(doc *ini.File, filename string, backup bool) error {
+	var buf = bytes.NewBuffer(nil)
+	_, err := doc.WriteTo(buf)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, buf.Bytes(), 0600, backup)
+}
+
+// writeFileAtomic makes sure the file is either completely written or left untouched:
+// the data is written to a temporary file which then replaces the original one.
+// If backup is set, the previous version is kept with the backup suffix.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode, backup bool) error {
+	dir := filepath.Dir(filename)
+
+	// keep the permissions of the existing file
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+
+		if backup {
+			previous, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return fmt.Errorf("reading %s for the backup: %w", filename, err)
+			}
+
+			err = writeFileAtomic(filename+backupSuffix, previous, perm, false)
+			if err != nil {
+				return fmt.Errorf("writing backup: %w", err)
+			}
+		}
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	// noop after a successful rename
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		return err
+	}
+
+	// make sure the rename itself is persisted
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Init writes a fresh config file with the default values.
+// Keys and the PSK are generated into the state file on the first load.
+func Init(filename string, force bool) error {
+	_, err := os.Stat(filename)
+	if err == nil && !force {
+		return fmt.Errorf("config: %s already exists", filename)
+	}
+
+	doc := ini.Empty()
+	doc.Section(ini.DefaultSection).Key("Version").SetValue(fmt.Sprint(CurrentVersion))
+	doc.Section("P2P").Key("ListenAddr").SetValue(DefaultP2PListenAddr)
+	doc.Section("P2P").Key("AnnounceInterval").SetValue(DefaultP2PAnnounceInterval.String())
+	doc.Section("Wireguard").Key("Interface").SetValue(DefaultWgInterface)
+	doc.Section("Wireguard").Key("ListenPort").SetValue(fmt.Sprint(DefaultWgListenPort))
+	doc.Section("Wireguard").Key("NetworkRange").SetValue(DefaultWgNetworkRange)
+	doc.Section("Wireguard").Key("PersistentKeepalive").SetValue(DefaultWgPersistentKeepalive.String())
+	doc.Section("Wireguard").Key("MTU").SetValue(MTUAuto)
+
+	err = writeDocument(doc, filename, true)
+	if err != nil {
+		return fmt.Errorf("config: saving %s: %w", filename, err)
+	}
+
+	return nil
+}
+
+// Join writes the network settings received in an invite to the config file.
+// The PSK is written to a secret file referenced with PSKFile: the configured one
+// or the one next to the config file. The rest of the config file is kept as is.
+func Join(filename, psk, networkRange, networkRange4 string, bootstrap []string) error {
+	doc, err := loadDocument(filename)
+	if err != nil {
+		return fmt.Errorf("config: loading %s: %w", filename, err)
+	}
+
+	if isEmptyDocument(doc) {
+		doc.Section(ini.DefaultSection).Key("Version").SetValue(fmt.Sprint(CurrentVersion))
+	}
+
+	pskFile := doc.Section("P2P").Key("PSKFile").String()
+	if pskFile == "" {
+		pskFile, err = filepath.Abs(defaultPSKFile(filename))
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+
+	// the secret file goes first, so the config never references a missing one
+	err = writeSecretFile(pskFile, psk)
+	if err != nil {
+		return fmt.Errorf("config: saving %s: %w", pskFile, err)
+	}
+
+	doc.Section("P2P").DeleteKey("PSK")
+	doc.Section("P2P").Key("PSKFile").SetValue(pskFile)
+	doc.Section("P2P").Key("Bootstrap").SetValue(strings.Join(bootstrap, ","))
+	doc.Section("Wireguard").Key("NetworkRange").SetValue(networkRange)
+	if networkRange4 != "" {
+		doc.Section("Wireguard").Key("NetworkRange4").SetValue(networkRange4)
+	}
+
+	err = writeDocument(doc, filename, true)
+	if err != nil {
+		return fmt.Errorf("config: saving %s: %w", filename, err)
+	}
+
+	return nil
+}
+
+// defaultPSKFile returns the PSK file path for the given config file.
+func defaultPSKFile(configFile string) string {
+	ext := filepath.Ext(configFile)
+	return strings.TrimSuffix(configFile, ext) + ".psk"
+}
+
+// writeSecretFile writes the secret readable by the current user only,
+// see readSecretFile.
+func writeSecretFile(filename, value string) error {
+	err := writeFileAtomic(filename, []byte(value+"\n"), 0600, false)
+	if err != nil {
+		return err
+	}
+
+	// the permissions of the existing file are kept by writeFileAtomic
+	return os.Chmod(filename, 0600)
+}
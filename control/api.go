@@ -0,0 +1,114 @@
+package control
+
+import (
+	"time"
+)
+
+// APIVersion prefixes all the API paths.
+// Incompatible changes are only made with a new version.
+const APIVersion = "v1"
+
+const (
+	PathStatus      = "/" + APIVersion + "/status"
+	PathPeers       = "/" + APIVersion + "/peers"
+	PathConnections = "/" + APIVersion + "/connections"
+	PathDevice      = "/" + APIVersion + "/device"
+	PathConfig      = "/" + APIVersion + "/config"
+	PathDryRun      = "/" + APIVersion + "/dry-run"
+	PathExport      = "/" + APIVersion + "/export"
+	PathAnnounce    = "/" + APIVersion + "/announce"
+	PathReconnect   = "/" + APIVersion + "/reconnect"
+	PathKeysRotate  = "/" + APIVersion + "/keys/rotate"
+	PathExitNode    = "/" + APIVersion + "/exit-node"
+)
+
+// Peer is a member of the network known from its announces.
+type Peer struct {
+	ID string `json:"id"`
+	// Addr is the ip the peer is connected from, used as the wireguard endpoint.
+	Addr string `json:"addr,omitempty"`
+	// P2PAddrs are the libp2p addrs announced by the peer.
+	P2PAddrs []string `json:"p2p_addrs,omitempty"`
+	// WireguardPublicKey is empty until the first announce is received.
+	WireguardPublicKey string `json:"wireguard_public_key,omitempty"`
+	OverlayAddr        string `json:"overlay_addr,omitempty"`
+	OverlayAddr4       string `json:"overlay_addr4,omitempty"`
+	WireguardPort      int    `json:"wireguard_port,omitempty"`
+}
+
+// Connection is a libp2p connection to the peer.
+type Connection struct {
+	Peer       string    `json:"peer"`
+	LocalAddr  string    `json:"local_addr"`
+	RemoteAddr string    `json:"remote_addr"`
+	Direction  string    `json:"direction"`
+	Opened     time.Time `json:"opened"`
+	Streams    int       `json:"streams"`
+}
+
+// Device is the state of the wireguard interface.
+// Private and preshared keys are never exposed.
+type Device struct {
+	Name       string       `json:"name"`
+	PublicKey  string       `json:"public_key"`
+	ListenPort int          `json:"listen_port"`
+	Peers      []DevicePeer `json:"peers"`
+}
+
+type DevicePeer struct {
+	PublicKey           string    `json:"public_key"`
+	Endpoint            string    `json:"endpoint,omitempty"`
+	AllowedIPs          []string  `json:"allowed_ips"`
+	LastHandshake       time.Time `json:"last_handshake"`
+	ReceiveBytes        int64     `json:"receive_bytes"`
+	TransmitBytes       int64     `json:"transmit_bytes"`
+	PersistentKeepalive string    `json:"persistent_keepalive"`
+}
+
+// Config is the summary of the running configuration without the secrets.
+type Config struct {
+	Version            int      `json:"version"`
+	PeerID             string   `json:"peer_id"`
+	PSKFingerprint     string   `json:"psk_fingerprint"`
+	ListenAddr         string   `json:"listen_addr"`
+	AnnounceInterval   string   `json:"announce_interval"`
+	Bootstrap          []string `json:"bootstrap"`
+	NodeName           string   `json:"node_name"`
+	Interface          string   `json:"interface"`
+	WireguardPublicKey string   `json:"wireguard_public_key"`
+	WireguardPort      int      `json:"wireguard_port"`
+	NetworkRange       string   `json:"network_range"`
+	NetworkRange4      string   `json:"network_range4,omitempty"`
+	// MTU is the current MTU of the interface, AutoMTU is set if it is discovered.
+	MTU     int  `json:"mtu"`
+	AutoMTU bool `json:"auto_mtu"`
+	// KeyRotation is set while the wireguard key rotation is pending.
+	KeyRotation *KeyRotation `json:"key_rotation,omitempty"`
+}
+
+// KeyRotation is the scheduled switch to the next wireguard key.
+type KeyRotation struct {
+	NextPublicKey string    `json:"next_public_key"`
+	Activation    time.Time `json:"activation"`
+}
+
+// ExitNode is the exit node selected for all the internet traffic.
+type ExitNode struct {
+	// Peer is empty if no exit node is used
+	Peer string `json:"peer"`
+	// Active is set once the traffic is routed via the exit node
+	Active bool `json:"active"`
+}
+
+// Operation is a wireguard change recorded, but not applied in the dry-run mode.
+type Operation struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Config []string  `json:"config"`
+	Diff   []string  `json:"diff"`
+}
+
+// Error is returned with non-2xx responses.
+type Error struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,153 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/derlaft/w2wesher/export"
+)
+
+const requestTimeout = time.Second * 30
+
+// Client talks to the running daemon over the control socket.
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socket string) *Client {
+	return &Client{
+		http: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the merged view of the mesh.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	err := c.do(ctx, http.MethodGet, PathStatus, &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *Client) Peers(ctx context.Context) ([]Peer, error) {
+	var peers []Peer
+	return peers, c.do(ctx, http.MethodGet, PathPeers, &peers)
+}
+
+func (c *Client) Connections(ctx context.Context) ([]Connection, error) {
+	var conns []Connection
+	return conns, c.do(ctx, http.MethodGet, PathConnections, &conns)
+}
+
+func (c *Client) Device(ctx context.Context) (*Device, error) {
+	var device Device
+	err := c.do(ctx, http.MethodGet, PathDevice, &device)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (c *Client) Config(ctx context.Context) (*Config, error) {
+	var cfg Config
+	err := c.do(ctx, http.MethodGet, PathConfig, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// DryRun returns the wireguard changes recorded in the dry-run mode.
+func (c *Client) DryRun(ctx context.Context) ([]Operation, error) {
+	var ops []Operation
+	return ops, c.do(ctx, http.MethodGet, PathDryRun, &ops)
+}
+
+// Export returns the mesh as seen by the node for a static configuration.
+func (c *Client) Export(ctx context.Context) (*export.Mesh, error) {
+	var mesh export.Mesh
+	err := c.do(ctx, http.MethodGet, PathExport, &mesh)
+	if err != nil {
+		return nil, err
+	}
+	return &mesh, nil
+}
+
+// Announce makes the node announce itself right away.
+func (c *Client) Announce(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, PathAnnounce, nil)
+}
+
+// Reconnect makes the node drop and re-establish the connections to all known peers.
+func (c *Client) Reconnect(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, PathReconnect, nil)
+}
+
+// RotateKey schedules the switch to a new wireguard key.
+func (c *Client) RotateKey(ctx context.Context) (*KeyRotation, error) {
+	var rotation KeyRotation
+	err := c.do(ctx, http.MethodPost, PathKeysRotate, &rotation)
+	if err != nil {
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+// SelectExitNode changes the exit node of the running daemon:
+// a peer ID, "off" or empty to follow the config.
+func (c *Client) SelectExitNode(ctx context.Context, peer string) (*ExitNode, error) {
+	var exit ExitNode
+	err := c.do(ctx, http.MethodPost, PathExitNode+"?peer="+url.QueryEscape(peer), &exit)
+	if err != nil {
+		return nil, err
+	}
+	return &exit, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, v interface{}) error {
+	// the host is ignored by the transport
+	req, err := http.NewRequestWithContext(ctx, method, "http://w2wesher"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("control: is w2wesher running? %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e Error
+		err = json.NewDecoder(resp.Body).Decode(&e)
+		if err != nil || e.Error == "" {
+			return fmt.Errorf("control: %s", resp.Status)
+		}
+		return fmt.Errorf("control: %s", e.Error)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("control: decoding response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package control
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+
+	"github.com/derlaft/w2wesher/export"
+	"github.com/derlaft/w2wesher/networkstate"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// export lists all the valid peers, including this node, for a static device.
+// The device keypair and address are left empty.
+func (s *Server) export(r *http.Request) (interface{}, error) {
+	cfg := s.config()
+
+	summary, err := s.configSummary(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var keepalive int
+	if cfg.Wireguard.PersistentKeepalive > 0 {
+		keepalive = int(cfg.Wireguard.PersistentKeepalive.Seconds())
+	}
+
+	mesh := export.Mesh{
+		Interface: export.Interface{
+			Name:          cfg.Wireguard.Interface,
+			NetworkRange:  cfg.Wireguard.NetworkRange,
+			NetworkRange4: cfg.Wireguard.NetworkRange4,
+			MTU:           s.wgControl.MTU(),
+		},
+		Peers: []export.Peer{},
+	}
+
+	// this node is reachable on the addrs libp2p listens on
+	self := s.wgControl.AnnounceInfo()
+	selfID, err := peer.Decode(summary.(Config).PeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the losing routes of the conflicts are not exported
+	rejected := make(map[peer.ID]map[string]bool)
+	for _, c := range s.state.RouteConflicts(selfID, self, cfg.Wireguard.LeaseExpiry) {
+		if rejected[c.Peer] == nil {
+			rejected[c.Peer] = make(map[string]bool)
+		}
+		rejected[c.Peer][c.Route] = true
+	}
+
+	selfPeer, ok := exportPeer(selfID, publicIP(cfg.State().Addrs()), self, keepalive, rejected[selfID])
+	if ok {
+		mesh.Peers = append(mesh.Peers, selfPeer)
+	}
+
+	var others []export.Peer
+	for _, info := range s.state.Snapshot() {
+		p, ok := exportPeer(info.ID, info.Addr, info.LastAnnounce.WireguardState, keepalive, rejected[info.ID])
+		if ok {
+			others = append(others, p)
+		}
+	}
+
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].ID < others[j].ID
+	})
+
+	mesh.Peers = append(mesh.Peers, others...)
+
+	return mesh, nil
+}
+
+func exportPeer(id peer.ID, ip string, ws networkstate.WireguardState, keepalive int, rejected map[string]bool) (export.Peer, bool) {
+	if !ws.IsValid() {
+		return export.Peer{}, false
+	}
+
+	addr, err := netip.ParseAddr(ws.SelectedAddr)
+	if err != nil {
+		return export.Peer{}, false
+	}
+
+	p := export.Peer{
+		ID:                  id.String(),
+		PublicKey:           ws.PublicKey,
+		AllowedIPs:          []string{netip.PrefixFrom(addr, addr.BitLen()).String()},
+		PersistentKeepalive: keepalive,
+	}
+
+	if addr4, err := netip.ParseAddr(ws.SelectedAddr4); err == nil {
+		p.AllowedIPs = append(p.AllowedIPs, netip.PrefixFrom(addr4, addr4.BitLen()).String())
+	}
+	for _, route := range ws.Routes {
+		if !rejected[route] {
+			p.AllowedIPs = append(p.AllowedIPs, route)
+		}
+	}
+	if ip != "" {
+		p.Endpoint = net.JoinHostPort(ip, strconv.Itoa(ws.Port))
+	}
+
+	return p, true
+}
+
+// publicIP returns the first non-loopback ip of the multiaddrs.
+func publicIP(addrs []string) string {
+	for _, raw := range addrs {
+		addr, err := multiaddr.NewMultiaddr(raw)
+		if err != nil || manet.IsIPLoopback(addr) {
+			continue
+		}
+
+		ip, err := manet.ToIP(addr)
+		if err == nil && !ip.IsUnspecified() {
+			return ip.String()
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,448 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/networkstate"
+	"github.com/derlaft/w2wesher/wg"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const shutdownTimeout = time.Second * 5
+
+var log = logging.Logger("w2wesher:control")
+
+// Node is the part of the p2p node exposed via the API.
+type Node interface {
+	Connections() []network.Conn
+	Announce(context.Context)
+	Reconnect(context.Context)
+}
+
+// Wireguard is the part of the wireguard adapter exposed via the API.
+type Wireguard interface {
+	AnnounceInfo() networkstate.WireguardState
+	Device() (*wgtypes.Device, error)
+	RotateKey() (wgtypes.Key, time.Time, error)
+	MTU() int
+	SelectExitNode(string) error
+	ExitNode() (string, bool)
+}
+
+// DryRun is the recorder of the wireguard changes in the dry-run mode.
+type DryRun interface {
+	Operations() []wg.Operation
+}
+
+// Server serves the JSON API on the unix socket.
+type Server struct {
+	cfgLock   sync.Mutex
+	cfg       *config.Config
+	state     *networkstate.State
+	node      Node
+	wgControl Wireguard
+	// dryRun is nil unless running in the dry-run mode
+	dryRun DryRun
+	// listener is created by Listen
+	listener net.Listener
+}
+
+// New creates the control server.
+// dryRun might be nil if not running in the dry-run mode.
+func New(cfg *config.Config, state *networkstate.State, node Node, wgControl Wireguard, dryRun DryRun) *Server {
+	return &Server{
+		cfg:       cfg,
+		state:     state,
+		node:      node,
+		wgControl: wgControl,
+		dryRun:    dryRun,
+	}
+}
+
+// Reload replaces the config reported by the API.
+// The socket settings are only used on the next start.
+func (s *Server) Reload(ctx context.Context, cfg *config.Config) {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+
+	s.cfg = cfg
+}
+
+func (s *Server) config() *config.Config {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+
+	return s.cfg
+}
+
+// Listen creates the control socket. Called before starting the others,
+// it makes the second instance fail before touching the interface of the running one.
+func (s *Server) Listen() error {
+	c := s.config().Control
+
+	l, err := listen(c.Socket, c.Group)
+	if err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+
+	s.listener = l
+	return nil
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	c := s.config().Control
+
+	if s.listener == nil {
+		err := s.Listen()
+		if err != nil {
+			return err
+		}
+	}
+	l := s.listener
+	defer os.Remove(c.Socket)
+
+	srv := &http.Server{
+		Handler: s.Handler(),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	var errs = make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(l)
+	}()
+
+	log.With("socket", c.Socket).Info("control socket is ready")
+
+	select {
+	case err := <-errs:
+		return fmt.Errorf("control: %w", err)
+	case <-ctx.Done():
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("control: %w", err)
+	}
+
+	return nil
+}
+
+// listen creates the socket accessible only to the owner and the group.
+func listen(socket, group string) (net.Listener, error) {
+	perm := os.FileMode(0600)
+	gid := -1
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return nil, err
+		}
+
+		perm = 0660
+	}
+
+	// remove the socket left after a crash, but never take over the one of a running daemon
+	if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		c, err := net.Dial("unix", socket)
+		switch {
+		case err == nil:
+			c.Close()
+			return nil, fmt.Errorf("%s is in use: w2wesher is already running", socket)
+		case !errors.Is(err, syscall.ECONNREFUSED):
+			return nil, fmt.Errorf("checking the existing socket %s: %w", socket, err)
+		}
+
+		err = os.Remove(socket)
+		if err != nil {
+			return nil, fmt.Errorf("removing the stale socket: %w", err)
+		}
+	}
+
+	// make sure the socket is never accessible by others, even for a moment
+	umask := syscall.Umask(0177)
+	l, err := net.Listen("unix", socket)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chown(socket, -1, gid)
+	if err == nil {
+		err = os.Chmod(socket, perm)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Handler returns the API handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle(PathStatus, get(s.status))
+	mux.Handle(PathPeers, get(s.peers))
+	mux.Handle(PathConnections, get(s.connections))
+	mux.Handle(PathDevice, get(s.device))
+	mux.Handle(PathConfig, get(s.configSummary))
+	mux.Handle(PathDryRun, get(s.operations))
+	mux.Handle(PathExport, get(s.export))
+	mux.Handle(PathAnnounce, post(s.announce))
+	mux.Handle(PathReconnect, post(s.reconnect))
+	mux.Handle(PathKeysRotate, post(s.rotateKey))
+	mux.Handle(PathExitNode, post(s.selectExitNode))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+	})
+
+	return mux
+}
+
+type handlerFunc func(r *http.Request) (interface{}, error)
+
+func get(fn handlerFunc) http.Handler {
+	return method(http.MethodGet, fn)
+}
+
+func post(fn handlerFunc) http.Handler {
+	return method(http.MethodPost, fn)
+}
+
+func method(m string, fn handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			w.Header().Set("Allow", m)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+
+		resp, err := fn(r)
+		if err != nil {
+			log.
+				With("path", r.URL.Path).
+				With("err", err).
+				Error("control request failed")
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, Error{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.
+			With("err", err).
+			Debug("could not write the response")
+	}
+}
+
+func (s *Server) peers(r *http.Request) (interface{}, error) {
+	var peers = []Peer{}
+	for _, info := range s.state.Snapshot() {
+		a := info.LastAnnounce
+
+		p := Peer{
+			ID:                 info.ID.String(),
+			Addr:               info.Addr,
+			WireguardPublicKey: a.WireguardState.PublicKey,
+			OverlayAddr:        a.WireguardState.SelectedAddr,
+			OverlayAddr4:       a.WireguardState.SelectedAddr4,
+			WireguardPort:      a.WireguardState.Port,
+		}
+		for _, addr := range a.AddrInfo.Addrs {
+			p.P2PAddrs = append(p.P2PAddrs, addr.String())
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers, nil
+}
+
+func (s *Server) connections(r *http.Request) (interface{}, error) {
+	var conns = []Connection{}
+	for _, c := range s.node.Connections() {
+		stat := c.Stat()
+		conns = append(conns, Connection{
+			Peer:       c.RemotePeer().String(),
+			LocalAddr:  c.LocalMultiaddr().String(),
+			RemoteAddr: c.RemoteMultiaddr().String(),
+			Direction:  stat.Direction.String(),
+			Opened:     stat.Opened,
+			Streams:    len(c.GetStreams()),
+		})
+	}
+
+	return conns, nil
+}
+
+func (s *Server) device(r *http.Request) (interface{}, error) {
+	d, err := s.wgControl.Device()
+	if err != nil {
+		return nil, err
+	}
+
+	var device = Device{
+		Name:       d.Name,
+		PublicKey:  d.PublicKey.String(),
+		ListenPort: d.ListenPort,
+		Peers:      []DevicePeer{},
+	}
+
+	for _, p := range d.Peers {
+		dp := DevicePeer{
+			PublicKey:           p.PublicKey.String(),
+			AllowedIPs:          []string{},
+			LastHandshake:       p.LastHandshakeTime,
+			ReceiveBytes:        p.ReceiveBytes,
+			TransmitBytes:       p.TransmitBytes,
+			PersistentKeepalive: p.PersistentKeepaliveInterval.String(),
+		}
+		if p.Endpoint != nil {
+			dp.Endpoint = p.Endpoint.String()
+		}
+		for _, ip := range p.AllowedIPs {
+			dp.AllowedIPs = append(dp.AllowedIPs, ip.String())
+		}
+
+		device.Peers = append(device.Peers, dp)
+	}
+
+	return device, nil
+}
+
+func (s *Server) configSummary(r *http.Request) (interface{}, error) {
+	cfg := s.config()
+
+	pk, err := cfg.P2P.LoadPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := peer.IDFromPrivateKey(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key might have been rotated since the config was loaded
+	ws := s.wgControl.AnnounceInfo()
+
+	var rotation *KeyRotation
+	if ws.NextPublicKey != "" {
+		rotation = &KeyRotation{
+			NextPublicKey: ws.NextPublicKey,
+			Activation:    time.Unix(ws.NextKeyActivation, 0),
+		}
+	}
+
+	bootstrap := append([]string{}, cfg.P2P.Bootstrap...)
+
+	return Config{
+		Version:            cfg.Version,
+		PeerID:             id.String(),
+		PSKFingerprint:     config.Fingerprint(cfg.P2P.PSK),
+		ListenAddr:         cfg.P2P.ListenAddr,
+		AnnounceInterval:   cfg.P2P.AnnounceInterval.String(),
+		Bootstrap:          bootstrap,
+		NodeName:           cfg.Wireguard.NodeName,
+		Interface:          cfg.Wireguard.Interface,
+		WireguardPublicKey: ws.PublicKey,
+		WireguardPort:      cfg.Wireguard.ListenPort,
+		NetworkRange:       cfg.Wireguard.NetworkRange,
+		NetworkRange4:      cfg.Wireguard.NetworkRange4,
+		MTU:                s.wgControl.MTU(),
+		AutoMTU:            cfg.Wireguard.MTU == config.MTUAuto,
+		KeyRotation:        rotation,
+	}, nil
+}
+
+func (s *Server) operations(r *http.Request) (interface{}, error) {
+	if s.dryRun == nil {
+		return nil, fmt.Errorf("not running in the dry-run mode")
+	}
+
+	var ops = []Operation{}
+	for _, op := range s.dryRun.Operations() {
+		ops = append(ops, Operation{
+			Time:   op.Time,
+			Kind:   op.Kind,
+			Config: op.Config,
+			Diff:   op.Diff,
+		})
+	}
+
+	return ops, nil
+}
+
+func (s *Server) announce(r *http.Request) (interface{}, error) {
+	s.node.Announce(r.Context())
+	return struct{}{}, nil
+}
+
+func (s *Server) reconnect(r *http.Request) (interface{}, error) {
+	s.node.Reconnect(r.Context())
+	return struct{}{}, nil
+}
+
+func (s *Server) rotateKey(r *http.Request) (interface{}, error) {
+	key, activation, err := s.wgControl.RotateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return KeyRotation{
+		NextPublicKey: key.String(),
+		Activation:    activation,
+	}, nil
+}
+
+// selectExitNode changes the exit node to the peer from the query:
+// a peer ID, "off" or empty to follow the config.
+func (s *Server) selectExitNode(r *http.Request) (interface{}, error) {
+	err := s.wgControl.SelectExitNode(r.URL.Query().Get("peer"))
+	if err != nil {
+		return nil, err
+	}
+
+	selected, active := s.wgControl.ExitNode()
+	return ExitNode{
+		Peer:   selected,
+		Active: active,
+	}, nil
+}
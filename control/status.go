@@ -0,0 +1,247 @@
+package control
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// staleHandshake is the age of the last handshake considered stale:
+// wireguard renews the session every two minutes while there is any traffic,
+// and the persistent keepalive makes sure there is.
+const staleHandshake = time.Minute * 5
+
+// Peer problems reported by the status.
+const (
+	// FlagNotConnected is set when there is no libp2p connection to the peer.
+	FlagNotConnected = "not-connected"
+	// FlagNoAnnounce is set when the peer is connected but has not announced its wireguard settings.
+	FlagNoAnnounce = "no-announce"
+	// FlagNoHandshake is set when the peer is announced but wireguard has never completed a handshake with it.
+	FlagNoHandshake = "no-handshake"
+	// FlagStaleHandshake is set when the last wireguard handshake is too old.
+	FlagStaleHandshake = "stale-handshake"
+	// FlagAddrConflict is set when the peer has lost an overlay address conflict
+	// and has not chosen another address yet.
+	FlagAddrConflict = "addr-conflict"
+	// FlagRouteConflict is set when some routes of the peer overlap the routes of the others
+	// and are not accepted.
+	FlagRouteConflict = "route-conflict"
+)
+
+// Status is the merged view of the mesh from this node.
+type Status struct {
+	PeerID             string `json:"peer_id"`
+	NodeName           string `json:"node_name"`
+	Interface          string `json:"interface"`
+	WireguardPublicKey string `json:"wireguard_public_key"`
+	OverlayAddr        string `json:"overlay_addr"`
+	OverlayAddr4       string `json:"overlay_addr4,omitempty"`
+	Claim              string `json:"claim"`
+	MTU                int    `json:"mtu"`
+	AutoMTU            bool   `json:"auto_mtu"`
+	// Routes are announced by this node
+	Routes []string `json:"routes"`
+	// ExitNode is the peer all the internet traffic is routed through once ExitNodeActive
+	ExitNode       string `json:"exit_node,omitempty"`
+	ExitNodeActive bool   `json:"exit_node_active"`
+	// DeviceError is set if the wireguard device state is unavailable.
+	DeviceError string       `json:"device_error,omitempty"`
+	Peers       []PeerStatus `json:"peers"`
+	// Conflicts lists the overlay addresses claimed by several peers.
+	Conflicts []AddrConflict `json:"conflicts"`
+	// RouteConflicts lists the announced routes which are not accepted
+	// because of overlapping with the routes of the others.
+	RouteConflicts []RouteConflict `json:"route_conflicts"`
+}
+
+// RouteConflict is a route of the peer overlapping the route kept by the winner.
+type RouteConflict struct {
+	Route    string `json:"route"`
+	Peer     string `json:"peer"`
+	Overlaps string `json:"overlaps"`
+	Winner   string `json:"winner"`
+}
+
+// AddrConflict is an overlay address claimed by several peers.
+// The winner keeps it, the losers choose other addresses.
+type AddrConflict struct {
+	Addr   string   `json:"addr"`
+	Winner string   `json:"winner"`
+	Losers []string `json:"losers"`
+}
+
+// PeerStatus joins everything known about a single peer.
+type PeerStatus struct {
+	ID string `json:"id"`
+	// announced wireguard settings
+	WireguardPublicKey string `json:"wireguard_public_key,omitempty"`
+	OverlayAddr        string `json:"overlay_addr,omitempty"`
+	OverlayAddr4       string `json:"overlay_addr4,omitempty"`
+	// Claim is how the overlay addresses are held: pinned, leased or proposed
+	Claim         string `json:"claim,omitempty"`
+	WireguardPort int    `json:"wireguard_port,omitempty"`
+	// Routes are announced behind the peer
+	Routes []string `json:"routes,omitempty"`
+	// ExitNode is set if the peer forwards the internet traffic of the others
+	ExitNode bool `json:"exit_node,omitempty"`
+	// Endpoint is the ip of the libp2p connection used for wireguard
+	Endpoint string `json:"endpoint,omitempty"`
+	// LastSeen is the time of the last announce, departed peers are removed after Wireguard.PeerTTL
+	LastSeen time.Time `json:"last_seen"`
+	// libp2p connection state
+	Connected   bool `json:"connected"`
+	Connections int  `json:"connections"`
+	// wireguard device state
+	LastHandshake time.Time `json:"last_handshake"`
+	ReceiveBytes  int64     `json:"receive_bytes"`
+	TransmitBytes int64     `json:"transmit_bytes"`
+	// Flags lists the detected problems
+	Flags []string `json:"flags"`
+}
+
+func (s *Server) status(r *http.Request) (interface{}, error) {
+	summary, err := s.configSummary(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg := summary.(Config)
+
+	own := s.wgControl.AnnounceInfo()
+
+	var (
+		peers  = make(map[string]*PeerStatus)
+		status = Status{
+			PeerID:             cfg.PeerID,
+			NodeName:           cfg.NodeName,
+			Interface:          cfg.Interface,
+			WireguardPublicKey: cfg.WireguardPublicKey,
+			MTU:                cfg.MTU,
+			AutoMTU:            cfg.AutoMTU,
+			OverlayAddr:        own.SelectedAddr,
+			OverlayAddr4:       own.SelectedAddr4,
+			Claim:              own.Claim,
+			Routes:             append([]string{}, own.Routes...),
+			Peers:              []PeerStatus{},
+			Conflicts:          []AddrConflict{},
+			RouteConflicts:     []RouteConflict{},
+		}
+		lost     = make(map[string]bool)
+		rejected = make(map[string]bool)
+	)
+
+	status.ExitNode, status.ExitNodeActive = s.wgControl.ExitNode()
+
+	self, err := peer.Decode(cfg.PeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range s.state.Conflicts(self, own, s.config().Wireguard.LeaseExpiry) {
+		conflict := AddrConflict{
+			Addr:   c.Addr,
+			Winner: c.Winner().String(),
+			Losers: []string{},
+		}
+		for _, id := range c.Losers() {
+			conflict.Losers = append(conflict.Losers, id.String())
+			lost[id.String()] = true
+		}
+		status.Conflicts = append(status.Conflicts, conflict)
+	}
+
+	for _, c := range s.state.RouteConflicts(self, own, s.config().Wireguard.LeaseExpiry) {
+		status.RouteConflicts = append(status.RouteConflicts, RouteConflict{
+			Route:    c.Route,
+			Peer:     c.Peer.String(),
+			Overlaps: c.Overlaps,
+			Winner:   c.Winner.String(),
+		})
+		rejected[c.Peer.String()] = true
+	}
+
+	get := func(id string) *PeerStatus {
+		p, ok := peers[id]
+		if !ok {
+			p = &PeerStatus{ID: id, Flags: []string{}}
+			peers[id] = p
+		}
+		return p
+	}
+
+	for _, info := range s.state.Snapshot() {
+		p := get(info.ID.String())
+		p.Endpoint = info.Addr
+		p.LastSeen = info.LastSeen
+		p.WireguardPublicKey = info.LastAnnounce.WireguardState.PublicKey
+		p.OverlayAddr = info.LastAnnounce.WireguardState.SelectedAddr
+		p.OverlayAddr4 = info.LastAnnounce.WireguardState.SelectedAddr4
+		p.Claim = info.LastAnnounce.WireguardState.Claim
+		p.WireguardPort = info.LastAnnounce.WireguardState.Port
+		p.Routes = info.LastAnnounce.WireguardState.Routes
+		p.ExitNode = info.LastAnnounce.WireguardState.ExitNode
+	}
+
+	for _, c := range s.node.Connections() {
+		p := get(c.RemotePeer().String())
+		p.Connected = true
+		p.Connections++
+	}
+
+	var devicePeers = make(map[string]wgtypes.Peer)
+	device, err := s.wgControl.Device()
+	if err != nil {
+		status.DeviceError = err.Error()
+	} else {
+		for _, dp := range device.Peers {
+			devicePeers[dp.PublicKey.String()] = dp
+		}
+	}
+
+	for _, p := range peers {
+		if p.ID == status.PeerID {
+			continue
+		}
+
+		dp, ok := devicePeers[p.WireguardPublicKey]
+		if ok {
+			p.LastHandshake = dp.LastHandshakeTime
+			p.ReceiveBytes = dp.ReceiveBytes
+			p.TransmitBytes = dp.TransmitBytes
+		}
+
+		if !p.Connected {
+			p.Flags = append(p.Flags, FlagNotConnected)
+		}
+
+		switch {
+		case p.WireguardPublicKey == "":
+			p.Flags = append(p.Flags, FlagNoAnnounce)
+		case status.DeviceError != "":
+			// handshake state is unknown
+		case p.LastHandshake.IsZero():
+			p.Flags = append(p.Flags, FlagNoHandshake)
+		case time.Since(p.LastHandshake) > staleHandshake:
+			p.Flags = append(p.Flags, FlagStaleHandshake)
+		}
+
+		if lost[p.ID] {
+			p.Flags = append(p.Flags, FlagAddrConflict)
+		}
+
+		if rejected[p.ID] {
+			p.Flags = append(p.Flags, FlagRouteConflict)
+		}
+
+		status.Peers = append(status.Peers, *p)
+	}
+
+	sort.Slice(status.Peers, func(i, j int) bool {
+		return status.Peers[i].ID < status.Peers[j].ID
+	})
+
+	return status, nil
+}
@@ -0,0 +1,312 @@
+package doctor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/vishvananda/netlink"
+)
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in the capability sets.
+const capNetAdmin = 12
+
+func checkNotRoot(cfg *config.Config) Result {
+	r := Result{Name: "user"}
+
+	if os.Geteuid() == 0 || os.Getegid() == 0 {
+		r.Status = Fail
+		r.Message = "running as root, w2wesher refuses to start"
+		r.Fix = "run as a dedicated user with CAP_NET_ADMIN (see dist/w2wesher.service)"
+		return r
+	}
+
+	r.Message = fmt.Sprintf("running as uid %d", os.Geteuid())
+	return r
+}
+
+// checkKeys reports the keys and the state which are only created on the first start.
+func checkKeys(cfg *config.Config) Result {
+	r := Result{Name: "keys"}
+
+	missing := cfg.Missing()
+	switch {
+	case len(missing) > 0:
+		r.Status = Warn
+		r.Message = fmt.Sprintf("%s not generated yet", strings.Join(missing, ", "))
+		r.Fix = "run `w2wesher init` or start the daemon once, the keys are kept in the state file"
+	case !cfg.StateExists():
+		r.Status = Warn
+		r.Message = "all the keys are configured, but the state file is not created yet"
+		r.Fix = "start the daemon once, the state file is created on the first start"
+	default:
+		r.Message = "configured"
+	}
+
+	return r
+}
+
+func checkModule(cfg *config.Config) Result {
+	r := Result{Name: "wireguard module"}
+
+	// both the loaded and the built-in modules are listed there
+	_, err := os.Stat("/sys/module/wireguard")
+	if err != nil {
+		r.Status = Fail
+		r.Message = "wireguard kernel module is not loaded"
+		r.Fix = "run `modprobe wireguard` as root; on linux older than 5.6 install it from https://www.wireguard.com/install/"
+		return r
+	}
+
+	r.Message = "available"
+	return r
+}
+
+func checkCapability(cfg *config.Config) Result {
+	r := Result{Name: "CAP_NET_ADMIN"}
+
+	effective, err := effectiveCapabilities()
+	if err != nil {
+		r.Status = Warn
+		r.Message = fmt.Sprintf("could not read the capabilities: %v", err)
+		return r
+	}
+
+	if effective&(1<<capNetAdmin) == 0 {
+		r.Status = Fail
+		r.Message = "missing, the wireguard interface can not be managed"
+		exe, _ := os.Executable()
+		r.Fix = fmt.Sprintf("run `setcap cap_net_admin=eip %s` as root, or set AmbientCapabilities=CAP_NET_ADMIN in the systemd unit", exe)
+		return r
+	}
+
+	r.Message = "present"
+	return r
+}
+
+// effectiveCapabilities reads the effective capability set of the process.
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := cutPrefix(scanner.Text(), "CapEff:")
+		if ok {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("CapEff not found")
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+func checkInterface(cfg *config.Config) Result {
+	name := cfg.Wireguard.Interface
+	r := Result{Name: "interface " + name}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		r.Message = "not used"
+		return r
+	}
+
+	if link.Type() != "wireguard" {
+		r.Status = Fail
+		r.Message = fmt.Sprintf("already used by a %s link", link.Type())
+		r.Fix = "set another Wireguard.Interface"
+		return r
+	}
+
+	r.Status = Warn
+	r.Message = "wireguard interface already exists"
+	r.Fix = "make sure no other w2wesher or wg-quick instance is using it"
+	return r
+}
+
+func checkP2PPort(cfg *config.Config) Result {
+	r := Result{Name: "p2p listen addr " + cfg.P2P.ListenAddr}
+
+	addr, err := multiaddr.NewMultiaddr(cfg.P2P.ListenAddr)
+	if err != nil {
+		r.Status = Fail
+		r.Message = err.Error()
+		r.Fix = "fix P2P.ListenAddr"
+		return r
+	}
+
+	// only the ip and the transport part is relevant
+	var transport multiaddr.Multiaddr
+	multiaddr.ForEach(addr, func(c multiaddr.Component) bool {
+		cp := c
+		if transport == nil {
+			transport = &cp
+		} else {
+			transport = transport.Encapsulate(&cp)
+		}
+		code := c.Protocol().Code
+		return code != multiaddr.P_TCP && code != multiaddr.P_UDP
+	})
+
+	netAddr, err := manet.ToNetAddr(transport)
+	if err != nil {
+		r.Status = Warn
+		r.Message = fmt.Sprintf("could not probe: %v", err)
+		return r
+	}
+
+	err = probe(netAddr.Network(), netAddr.String())
+	if err != nil {
+		r.Status = Fail
+		r.Message = fmt.Sprintf("can not be bound: %v", err)
+		r.Fix = "stop the process using the port (is w2wesher already running?) or change P2P.ListenAddr"
+		return r
+	}
+
+	r.Message = "bindable"
+	return r
+}
+
+func checkWireguardPort(cfg *config.Config) Result {
+	port := cfg.Wireguard.ListenPort
+	r := Result{Name: fmt.Sprintf("wireguard port %d/udp", port)}
+
+	err := probe("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		r.Status = Fail
+		r.Message = fmt.Sprintf("can not be bound: %v", err)
+		r.Fix = "stop the process using the port (is w2wesher already running?) or change Wireguard.ListenPort"
+		return r
+	}
+
+	r.Message = "bindable"
+	return r
+}
+
+// probe binds the addr and releases it right away.
+func probe(network, addr string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return err
+		}
+		return l.Close()
+	default:
+		c, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
+
+// checkMasquerade looks for the tools the exit node masquerade is set up with.
+func checkMasquerade(cfg *config.Config) Result {
+	r := Result{Name: "exit node masquerade"}
+
+	if !cfg.Wireguard.ExitNodeMasquerade {
+		r.Message = "not configured"
+		return r
+	}
+
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			r.Status = Fail
+			r.Message = fmt.Sprintf("%s is not found", tool)
+			r.Fix = fmt.Sprintf("install %s, it has to run with the ambient CAP_NET_ADMIN (see dist/w2wesher.service)", tool)
+			return r
+		}
+	}
+
+	r.Message = "iptables and ip6tables found"
+	return r
+}
+
+func checkRoutes(cfg *config.Config) Result {
+	return checkRange(cfg, "NetworkRange", cfg.Wireguard.NetworkRange)
+}
+
+func checkRoutes4(cfg *config.Config) Result {
+	if cfg.Wireguard.NetworkRange4 == "" {
+		return Result{Name: "IPv4 network range", Message: "not configured"}
+	}
+
+	return checkRange(cfg, "NetworkRange4", cfg.Wireguard.NetworkRange4)
+}
+
+// checkRange looks for the routes overlapping with the overlay network.
+func checkRange(cfg *config.Config, key, networkRange string) Result {
+	r := Result{Name: "network range " + networkRange}
+
+	prefix, err := netip.ParsePrefix(networkRange)
+	if err != nil {
+		r.Status = Fail
+		r.Message = err.Error()
+		r.Fix = "fix Wireguard." + key
+		return r
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		r.Status = Warn
+		r.Message = fmt.Sprintf("could not list the routes: %v", err)
+		return r
+	}
+
+	var conflicts []string
+	for _, route := range routes {
+		if route.Dst == nil {
+			// default route is less specific than anything
+			continue
+		}
+
+		dst, err := netip.ParsePrefix(route.Dst.String())
+		if err != nil || !dst.Overlaps(prefix) {
+			continue
+		}
+
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err == nil && link.Attrs().Name == cfg.Wireguard.Interface {
+			// route managed by w2wesher itself
+			continue
+		}
+
+		dev := "?"
+		if err == nil {
+			dev = link.Attrs().Name
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%s dev %s", dst, dev))
+	}
+
+	if len(conflicts) > 0 {
+		r.Status = Fail
+		r.Message = "overlaps with the existing routes: " + strings.Join(conflicts, ", ")
+		r.Fix = "choose another Wireguard." + key
+		return r
+	}
+
+	r.Message = "no conflicting routes"
+	return r
+}
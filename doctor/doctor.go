@@ -0,0 +1,92 @@
+// Package doctor checks the environment w2wesher is going to run in.
+package doctor
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/derlaft/w2wesher/config"
+)
+
+type Status int
+
+const (
+	OK Status = iota
+	Warn
+	Fail
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return " ok "
+	case Warn:
+		return "warn"
+	default:
+		return "FAIL"
+	}
+}
+
+// Result of a single check.
+type Result struct {
+	Name    string
+	Status  Status
+	Message string
+	// Fix is the suggested action, if any
+	Fix string
+}
+
+type check func(cfg *config.Config) Result
+
+var checks = []check{
+	checkNotRoot,
+	checkKeys,
+	checkModule,
+	checkCapability,
+	checkInterface,
+	checkP2PPort,
+	checkWireguardPort,
+	checkRoutes,
+	checkRoutes4,
+	checkMasquerade,
+}
+
+// Run performs all the checks.
+func Run(cfg *config.Config) []Result {
+	var results []Result
+	for _, c := range checks {
+		results = append(results, c(cfg))
+	}
+
+	return results
+}
+
+// Failed returns true if any of the checks has failed.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == Fail {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Print writes the human-readable report.
+func Print(w io.Writer, results []Result) error {
+	for _, r := range results {
+		_, err := fmt.Fprintf(w, "[%s] %s: %s\n", r.Status, r.Name, r.Message)
+		if err != nil {
+			return err
+		}
+
+		if r.Fix != "" && r.Status != OK {
+			_, err = fmt.Fprintf(w, "       fix: %s\n", r.Fix)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Package export renders the mesh as a static wireguard configuration
+// for the devices which can not run w2wesher.
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Placeholders are used when the device keypair and address are not generated.
+const (
+	PlaceholderPrivateKey = "<PRIVATE KEY>"
+	PlaceholderAddress    = "<ADDRESS>"
+	PlaceholderAddress4   = "<ADDRESS4>"
+)
+
+// Mesh is the static view of the mesh for a new device.
+type Mesh struct {
+	Interface Interface `json:"interface"`
+	Peers     []Peer    `json:"peers"`
+}
+
+// Interface is the configuration of the device itself.
+type Interface struct {
+	Name string `json:"name"`
+	// PrivateKey is empty unless generated for the device
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+	// Address of the device with the prefix length of the network range
+	Address      string `json:"address,omitempty"`
+	NetworkRange string `json:"network_range"`
+	// Address4 and NetworkRange4 are set if the IPv4 overlay network is configured
+	Address4      string `json:"address4,omitempty"`
+	NetworkRange4 string `json:"network_range4,omitempty"`
+	MTU           int    `json:"mtu"`
+}
+
+// Peer is a mesh member.
+type Peer struct {
+	// ID is the libp2p peer ID, used as a name in the comments
+	ID         string   `json:"id"`
+	PublicKey  string   `json:"public_key"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	AllowedIPs []string `json:"allowed_ips"`
+	// PersistentKeepalive in seconds, 0 to disable
+	PersistentKeepalive int `json:"persistent_keepalive,omitempty"`
+}
+
+func (m *Mesh) privateKey() string {
+	if m.Interface.PrivateKey == "" {
+		return PlaceholderPrivateKey
+	}
+	return m.Interface.PrivateKey
+}
+
+func (m *Mesh) addresses() []string {
+	addrs := []string{m.Interface.Address}
+	if addrs[0] == "" {
+		addrs[0] = PlaceholderAddress
+	}
+
+	switch {
+	case m.Interface.Address4 != "":
+		addrs = append(addrs, m.Interface.Address4)
+	case m.Interface.NetworkRange4 != "":
+		addrs = append(addrs, PlaceholderAddress4)
+	}
+
+	return addrs
+}
+
+// WriteJSON writes the mesh as JSON.
+func WriteJSON(w io.Writer, m *Mesh) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// WriteWgQuick writes the wg-quick configuration.
+func WriteWgQuick(w io.Writer, m *Mesh) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# w2wesher mesh %s, generated for %s\n", m.Interface.NetworkRange, m.Interface.Name)
+	fmt.Fprintf(&b, "[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", m.privateKey())
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(m.addresses(), ", "))
+	fmt.Fprintf(&b, "MTU = %d\n", m.Interface.MTU)
+
+	for _, p := range m.Peers {
+		fmt.Fprintf(&b, "\n# %s\n", p.ID)
+		fmt.Fprintf(&b, "[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", p.PublicKey)
+		if p.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", p.Endpoint)
+		}
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(p.AllowedIPs, ", "))
+		if p.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", p.PersistentKeepalive)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteNetdev writes the systemd-networkd .netdev file.
+func WriteNetdev(w io.Writer, m *Mesh) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# w2wesher mesh %s\n", m.Interface.NetworkRange)
+	fmt.Fprintf(&b, "[NetDev]\n")
+	fmt.Fprintf(&b, "Name = %s\n", m.Interface.Name)
+	fmt.Fprintf(&b, "Kind = wireguard\n")
+	fmt.Fprintf(&b, "MTUBytes = %d\n", m.Interface.MTU)
+	fmt.Fprintf(&b, "\n[WireGuard]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", m.privateKey())
+
+	for _, p := range m.Peers {
+		fmt.Fprintf(&b, "\n# %s\n", p.ID)
+		fmt.Fprintf(&b, "[WireGuardPeer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", p.PublicKey)
+		if p.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", p.Endpoint)
+		}
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(p.AllowedIPs, ", "))
+		if p.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", p.PersistentKeepalive)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteNetwork writes the systemd-networkd .network file.
+func WriteNetwork(w io.Writer, m *Mesh) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# w2wesher mesh %s\n", m.Interface.NetworkRange)
+	fmt.Fprintf(&b, "[Match]\n")
+	fmt.Fprintf(&b, "Name = %s\n", m.Interface.Name)
+	fmt.Fprintf(&b, "\n[Network]\n")
+	for _, addr := range m.addresses() {
+		fmt.Fprintf(&b, "Address = %s\n", addr)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,183 @@
+package invite
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Protocol is used by the joining node to redeem one-time invites.
+const Protocol = "/w2wesher/invite/1.0.0"
+
+// tokenPrefix identifies the token format version.
+const tokenPrefix = "w2w1."
+
+// nonceLength is the length of the one-time-use nonce in bytes.
+const nonceLength = 16
+
+var ErrExpired = errors.New("invite: token expired")
+
+// Token contains everything needed to join the network.
+// It includes the network PSK: anyone having the token can join.
+type Token struct {
+	// Issuer is the node which created and signed the token.
+	Issuer peer.ID `json:"iss"`
+	// PSK is the network PSK.
+	PSK string `json:"psk"`
+	// NetworkRange is the wireguard overlay network range.
+	NetworkRange string `json:"net"`
+	// NetworkRange4 is the optional IPv4 overlay network range.
+	NetworkRange4 string `json:"net4,omitempty"`
+	// Bootstrap is a list of p2p multiaddrs to connect to.
+	Bootstrap []string `json:"bs"`
+	// Expires is a unix timestamp, 0 for the tokens which never expire.
+	Expires int64 `json:"exp,omitempty"`
+	// Nonce is set for the one-time-use tokens.
+	// Such tokens are redeemed with the issuer on the first start.
+	Nonce string `json:"nonce,omitempty"`
+	// Signature of the issuer over the rest of the token.
+	Signature []byte `json:"sig,omitempty"`
+}
+
+// Options of the new token.
+type Options struct {
+	// Expire is the token lifetime, 0 for no expiry.
+	Expire time.Duration
+	// Once makes the token one-time-use.
+	Once bool
+}
+
+// New creates an unsigned token.
+func New(issuer peer.ID, psk, networkRange, networkRange4 string, bootstrap []string, opts Options) (*Token, error) {
+	t := &Token{
+		Issuer:        issuer,
+		PSK:           psk,
+		NetworkRange:  networkRange,
+		NetworkRange4: networkRange4,
+		Bootstrap:     bootstrap,
+	}
+
+	if opts.Expire > 0 {
+		t.Expires = time.Now().Add(opts.Expire).Unix()
+	}
+
+	if opts.Once {
+		var nonce = make([]byte, nonceLength)
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+		t.Nonce = base64.RawURLEncoding.EncodeToString(nonce)
+	}
+
+	return t, nil
+}
+
+// Expired checks if the token is still valid.
+func (t *Token) Expired() bool {
+	return t.Expires > 0 && time.Now().Unix() > t.Expires
+}
+
+func (t *Token) payload() ([]byte, error) {
+	cp := *t
+	cp.Signature = nil
+	return json.Marshal(cp)
+}
+
+// Encode signs the token and encodes it in a copy-pasteable form.
+func (t *Token) Encode(key crypto.PrivKey) (string, error) {
+	payload, err := t.payload()
+	if err != nil {
+		return "", err
+	}
+
+	t.Signature, err = key.Sign(payload)
+	if err != nil {
+		return "", fmt.Errorf("invite: signing token: %w", err)
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Decode decodes the token and verifies the issuer signature.
+// Expiration is not checked.
+func Decode(token string) (*Token, error) {
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, fmt.Errorf("invite: unsupported token format")
+	}
+
+	compressed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, tokenPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invite: decoding token: %w", err)
+	}
+
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return nil, fmt.Errorf("invite: decompressing token: %w", err)
+	}
+
+	var t Token
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return nil, fmt.Errorf("invite: decoding token: %w", err)
+	}
+
+	pub, err := t.Issuer.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("invite: extracting issuer key: %w", err)
+	}
+
+	payload, err := t.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := pub.Verify(payload, t.Signature)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("invite: invalid token signature")
+	}
+
+	return &t, nil
+}
+
+// BootstrapPeers parses the bootstrap addrs of the token.
+func (t *Token) BootstrapPeers() ([]peer.AddrInfo, error) {
+	var peers []peer.AddrInfo
+	for _, rawAddr := range t.Bootstrap {
+		addr, err := peer.AddrInfoFromString(rawAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invite: invalid bootstrap addr %v: %w", rawAddr, err)
+		}
+		peers = append(peers, *addr)
+	}
+	return peers, nil
+}
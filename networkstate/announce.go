@@ -9,12 +9,39 @@ import (
 type Announce struct {
 	WireguardState WireguardState `json:"wg"`
 	AddrInfo       peer.AddrInfo  `json:"ai"`
+	// Next is the host using the next PSK during the PSK rotation.
+	Next *peer.AddrInfo `json:"next,omitempty"`
+	// StaticPeers are the plain wireguard devices sponsored by the node.
+	StaticPeers []StaticPeer `json:"static,omitempty"`
+}
+
+// StaticPeer is a plain wireguard device announced by its sponsor.
+type StaticPeer struct {
+	Name       string   `json:"name"`
+	PublicKey  string   `json:"pk"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	AllowedIPs []string `json:"ips"`
 }
 
 type WireguardState struct {
 	PublicKey    string `json:"pk"`
 	SelectedAddr string `json:"ip"`
-	Port         int    `json:"port"`
+	// SelectedAddr4 is set if the IPv4 overlay network is configured.
+	SelectedAddr4 string `json:"ip4,omitempty"`
+	// Claim tells how the addresses are held, see conflict.go.
+	Claim string `json:"claim,omitempty"`
+	Port  int    `json:"port"`
+	// Routes are the prefixes reachable behind the node.
+	Routes []string `json:"routes,omitempty"`
+	// ExitNode is set if the node forwards the internet traffic of the others.
+	ExitNode bool `json:"exit,omitempty"`
+	// NextPublicKey replaces PublicKey at NextKeyActivation (unix time).
+	NextPublicKey     string `json:"npk,omitempty"`
+	NextKeyActivation int64  `json:"nat,omitempty"`
+	// PSKVersion is set if the node derives the preshared keys from the network PSK,
+	// rotated every PSKRotation seconds.
+	PSKVersion  int   `json:"pskv,omitempty"`
+	PSKRotation int64 `json:"pskr,omitempty"`
 }
 
 func (ws WireguardState) IsValid() bool {
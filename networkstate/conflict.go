@@ -0,0 +1,152 @@
+package networkstate
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Claims of the overlay addresses, the stronger ones go first.
+const (
+	// ClaimPinned is an address set by the operator.
+	ClaimPinned = "pinned"
+	// ClaimLeased is an address held for a while, the nodes of the older versions
+	// announce no claim and are treated the same way.
+	ClaimLeased = "leased"
+	// ClaimProposed is an address waiting for the conflicting claims before it is leased.
+	ClaimProposed = "proposed"
+)
+
+func claimRank(claim string) int {
+	switch claim {
+	case ClaimPinned:
+		return 0
+	case ClaimProposed:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Conflict is an overlay address claimed by more than one peer.
+type Conflict struct {
+	Addr string
+	// Peers are ordered by the tie-break rule: the first one keeps the address.
+	Peers []peer.ID
+	// Unresolved is set if the address is pinned by more than one peer:
+	// the claims can not be verified, so nobody keeps the address until the operator fixes it.
+	Unresolved bool
+}
+
+// Winner returns the peer keeping the address, if any.
+func (c Conflict) Winner() peer.ID {
+	if c.Unresolved {
+		return ""
+	}
+	return c.Peers[0]
+}
+
+// Losers returns the peers which have to choose another address.
+func (c Conflict) Losers() []peer.ID {
+	if c.Unresolved {
+		return c.Peers
+	}
+	return c.Peers[1:]
+}
+
+// Lost returns true if the peer has to choose another address.
+func (c Conflict) Lost(id peer.ID) bool {
+	for _, p := range c.Losers() {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Live returns the peers which have announced their wireguard settings
+// within the expiry, or ever if the expiry is 0.
+func (s *State) Live(expiry time.Duration) []Info {
+	var live []Info
+	for _, info := range s.Snapshot() {
+		if !info.LastAnnounce.WireguardState.IsValid() {
+			continue
+		}
+
+		if expiry > 0 && time.Since(info.LastSeen) > expiry {
+			continue
+		}
+
+		live = append(live, info)
+	}
+	return live
+}
+
+// Conflicts finds the overlay addresses claimed by more than one live peer,
+// including the addresses of the local node announced as self.
+// The strongest claim keeps the address, then the lowest peer ID,
+// so all the nodes agree on the winner. The addresses pinned
+// by more than one peer are not kept by anyone.
+func (s *State) Conflicts(self peer.ID, own WireguardState, expiry time.Duration) []Conflict {
+	type claimant struct {
+		id   peer.ID
+		rank int
+	}
+
+	// the addresses are compared parsed: the same one might be written differently
+	claims := make(map[netip.Addr][]claimant)
+	claim := func(id peer.ID, ws WireguardState) {
+		seen := make(map[netip.Addr]bool)
+		for _, raw := range []string{ws.SelectedAddr, ws.SelectedAddr4} {
+			addr, err := netip.ParseAddr(raw)
+			if err != nil {
+				// not set or invalid, never installed anyway
+				continue
+			}
+
+			addr = addr.Unmap()
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+
+			claims[addr] = append(claims[addr], claimant{id, claimRank(ws.Claim)})
+		}
+	}
+
+	claim(self, own)
+	for _, info := range s.Live(expiry) {
+		if info.ID != self {
+			claim(info.ID, info.LastAnnounce.WireguardState)
+		}
+	}
+
+	var conflicts []Conflict
+	for addr, claimants := range claims {
+		if len(claimants) < 2 {
+			continue
+		}
+
+		sort.Slice(claimants, func(i, j int) bool {
+			if claimants[i].rank != claimants[j].rank {
+				return claimants[i].rank < claimants[j].rank
+			}
+			return claimants[i].id < claimants[j].id
+		})
+
+		c := Conflict{Addr: addr.String()}
+		for _, cl := range claimants {
+			c.Peers = append(c.Peers, cl.id)
+		}
+		c.Unresolved = claimants[1].rank == claimRank(ClaimPinned)
+		conflicts = append(conflicts, c)
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Addr < conflicts[j].Addr
+	})
+
+	return conflicts
+}
@@ -2,6 +2,7 @@ package networkstate
 
 import (
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
@@ -13,8 +14,22 @@ type State struct {
 }
 
 type Info struct {
+	ID           peer.ID
 	LastAnnounce Announce
-	Addr         string
+	// LastSeen is the time of the last announce
+	LastSeen time.Time
+	// LastHandshake is the time of the last wireguard handshake with the node
+	LastHandshake time.Time
+	Addr          string
+}
+
+// LastActive returns the last time the node was heard of
+// either via libp2p or wireguard.
+func (i Info) LastActive() time.Time {
+	if i.LastHandshake.After(i.LastSeen) {
+		return i.LastHandshake
+	}
+	return i.LastSeen
 }
 
 func New() *State {
@@ -29,11 +44,45 @@ func (s *State) OnAnnounce(from peer.ID, a Announce) {
 
 	info, ok := s.info[from]
 	if !ok {
-		info = new(Info)
+		info = &Info{ID: from}
 		s.info[from] = info
 	}
 
 	info.LastAnnounce = a
+	info.LastSeen = time.Now()
+}
+
+// OnLeave forgets the static peers sponsored by the node which has left.
+// They are restored with the next announce of the sponsor.
+func (s *State) OnLeave(from peer.ID) {
+	s.Lock()
+	defer s.Unlock()
+
+	info, ok := s.info[from]
+	if ok {
+		info.LastAnnounce.StaticPeers = nil
+	}
+}
+
+// UpdateHandshakes records the last wireguard handshakes with the known nodes.
+func (s *State) UpdateHandshakes(handshakes map[peer.ID]time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for id, t := range handshakes {
+		info, ok := s.info[id]
+		if ok && t.After(info.LastHandshake) {
+			info.LastHandshake = t
+		}
+	}
+}
+
+// Remove forgets the departed node, it is added back by the next announce.
+func (s *State) Remove(id peer.ID) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.info, id)
 }
 
 func (s *State) UpdateAddrs(addrs map[peer.ID]multiaddr.Multiaddr) {
@@ -43,7 +92,7 @@ func (s *State) UpdateAddrs(addrs map[peer.ID]multiaddr.Multiaddr) {
 	for peer, addr := range addrs {
 		info, ok := s.info[peer]
 		if !ok {
-			info = new(Info)
+			info = &Info{ID: peer}
 			s.info[peer] = info
 		}
 
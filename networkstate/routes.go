@@ -0,0 +1,82 @@
+package networkstate
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// RouteConflict is an advertised route overlapping a route of another peer.
+type RouteConflict struct {
+	// Route is not accepted from Peer
+	Route string
+	Peer  peer.ID
+	// Overlaps is the route of Winner kept instead
+	Overlaps string
+	Winner   peer.ID
+}
+
+type advertisedRoute struct {
+	id     peer.ID
+	prefix netip.Prefix
+}
+
+// RouteConflicts finds the routes advertised by the live peers overlapping
+// the routes of the others, including the routes of the local node announced as self.
+// The routes of the lowest peer ID are kept, so all the nodes agree on the winner.
+func (s *State) RouteConflicts(self peer.ID, own WireguardState, expiry time.Duration) []RouteConflict {
+	var routes []advertisedRoute
+	advertise := func(id peer.ID, ws WireguardState) {
+		for _, raw := range ws.Routes {
+			prefix, err := netip.ParsePrefix(raw)
+			if err == nil {
+				routes = append(routes, advertisedRoute{id, prefix.Masked()})
+			}
+		}
+	}
+
+	advertise(self, own)
+	for _, info := range s.Live(expiry) {
+		if info.ID != self {
+			advertise(info.ID, info.LastAnnounce.WireguardState)
+		}
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].id < routes[j].id
+	})
+
+	var (
+		kept      []advertisedRoute
+		conflicts []RouteConflict
+	)
+
+	for _, r := range routes {
+		winner, ok := overlapping(kept, r)
+		if !ok {
+			kept = append(kept, r)
+			continue
+		}
+
+		conflicts = append(conflicts, RouteConflict{
+			Route:    r.prefix.String(),
+			Peer:     r.id,
+			Overlaps: winner.prefix.String(),
+			Winner:   winner.id,
+		})
+	}
+
+	return conflicts
+}
+
+// overlapping returns the route of another peer overlapping r.
+func overlapping(routes []advertisedRoute, r advertisedRoute) (advertisedRoute, bool) {
+	for _, k := range routes {
+		if k.id != r.id && k.prefix.Overlaps(r.prefix) {
+			return k, true
+		}
+	}
+	return advertisedRoute{}, false
+}
@@ -3,17 +3,22 @@ package p2p
 import (
 	"context"
 	"fmt"
-	"sort"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"golang.org/x/exp/slices"
+	manet "github.com/multiformats/go-multiaddr/net"
 )
 
 const rebootstrapInterval = time.Second * 10
 
 func (w *worker) initialBootstrap(ctx context.Context) error {
-	bootstrap, err := w.cfg.P2P.LoadBootstrapPeers()
+	if !w.primary.Load() {
+		w.bootstrapNext(ctx)
+		return nil
+	}
+
+	bootstrap, err := w.config().LoadBootstrapPeers()
 	if err != nil {
 		return err
 	}
@@ -25,8 +30,28 @@ func (w *worker) initialBootstrap(ctx context.Context) error {
 	return nil
 }
 
+// bootstrapNext connects the host waiting for the PSK rotation
+// to the hosts of the other nodes using the same next PSK.
+func (w *worker) bootstrapNext(ctx context.Context) {
+	for _, info := range w.state.Snapshot() {
+		next := info.LastAnnounce.Next
+		if next == nil || next.ID == w.host.ID() {
+			continue
+		}
+
+		if w.host.Network().Connectedness(next.ID) != network.Connected {
+			go w.connect(ctx, *next)
+		}
+	}
+}
+
 func (w *worker) bootstrapOnce(ctx context.Context) error {
 
+	if !w.primary.Load() {
+		w.bootstrapNext(ctx)
+		return nil
+	}
+
 	// list of all known addrs
 	var knownAddrs []string
 
@@ -53,19 +78,25 @@ func (w *worker) bootstrapOnce(ctx context.Context) error {
 		}
 	}
 
-	// sort && compare
-	sort.Strings(knownAddrs)
-	var listChanged = !slices.Equal(knownAddrs, w.cfg.P2P.Bootstrap)
+	// save the state if the list has changed
+	err := w.config().State().UpdateBootstrap(knownAddrs)
+	if err != nil {
+		return fmt.Errorf("bootstrap: failed updating bootstrap peers: %w", err)
+	}
 
-	// save config if it is changed
-	if listChanged {
-		w.cfg.P2P.Bootstrap = knownAddrs
-		err := w.cfg.Save()
-		if err != nil {
-			return fmt.Errorf("bootstrap: failed updating bootstrap peers")
+	// remember own addrs for the invites
+	var selfAddrs []string
+	for _, addr := range w.host.Addrs() {
+		if !manet.IsIPLoopback(addr) {
+			selfAddrs = append(selfAddrs, addr.String())
 		}
 	}
 
+	err = w.config().State().UpdateAddrs(selfAddrs)
+	if err != nil {
+		return fmt.Errorf("bootstrap: failed updating own addrs: %w", err)
+	}
+
 	connectedPeers := w.host.Network().Peers()
 	log.Infof("Connected to %v/%v peers", len(connectedPeers), len(peersWithAddrs)-1)
 
@@ -0,0 +1,67 @@
+package p2p
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// ready returns the primary worker if its host is started.
+func (n *node) ready() *worker {
+	primary, _ := n.workers()
+	select {
+	case <-primary.ready:
+		return primary
+	default:
+		return nil
+	}
+}
+
+// Connections lists the libp2p connections of the primary host.
+func (n *node) Connections() []network.Conn {
+	w := n.ready()
+	if w == nil {
+		return nil
+	}
+
+	return w.host.Network().Conns()
+}
+
+// Announce publishes the local state right away.
+func (n *node) Announce(ctx context.Context) {
+	w := n.ready()
+	if w == nil {
+		return
+	}
+
+	w.announceLocal(ctx)
+}
+
+// Reconnect drops the connections to all the known peers and establishes them again,
+// e.g. to pick up the changed addrs after roaming.
+func (n *node) Reconnect(ctx context.Context) {
+	w := n.ready()
+	if w == nil {
+		return
+	}
+
+	log.Info("reconnecting to all the known peers")
+
+	ps := w.host.Peerstore()
+	for _, p := range ps.PeersWithAddrs() {
+		if p == w.host.ID() {
+			continue
+		}
+
+		err := w.host.Network().ClosePeer(p)
+		if err != nil {
+			log.
+				With("id", p).
+				With("err", err).
+				Debug("could not close connection")
+		}
+
+		// connections outlive the request
+		go w.connect(n.ctx, ps.PeerInfo(p))
+	}
+}
@@ -0,0 +1,163 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/derlaft/w2wesher/invite"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// maxTokenSize limits the size of the redeemed token
+	maxTokenSize = 4096
+	// redeemTimeout limits a single redeem attempt
+	redeemTimeout = time.Second * 16
+	// redeemAccepted is the response of the issuer to a successful redeem
+	redeemAccepted = "ok"
+)
+
+// ErrInviteRefused is returned if the one-time invite was refused by the issuer.
+var ErrInviteRefused = errors.New("invite was refused by the issuer")
+
+// handleRedeem is called on the issuer when a new node redeems
+// a one-time-use invite.
+func (w *worker) handleRedeem(s network.Stream) {
+	defer s.Close()
+
+	_ = s.SetDeadline(time.Now().Add(redeemTimeout))
+
+	data, err := ioutil.ReadAll(io.LimitReader(s, maxTokenSize))
+	if err != nil {
+		log.
+			With("err", err).
+			Error("could not read invite")
+		_ = s.Reset()
+		return
+	}
+
+	err = w.redeem(string(data))
+	if err != nil {
+		log.
+			With("peer", s.Conn().RemotePeer()).
+			With("err", err).
+			Warn("refused to redeem invite")
+		fmt.Fprintf(s, "%v\n", err)
+		return
+	}
+
+	log.
+		With("peer", s.Conn().RemotePeer()).
+		Info("invite redeemed")
+	fmt.Fprintln(s, redeemAccepted)
+}
+
+func (w *worker) redeem(token string) error {
+	t, err := invite.Decode(token)
+	if err != nil {
+		return err
+	}
+
+	if t.Issuer != w.host.ID() {
+		return fmt.Errorf("invite was issued by another node")
+	}
+
+	if t.Expired() {
+		return invite.ErrExpired
+	}
+
+	if t.Nonce == "" {
+		// nothing to redeem
+		return nil
+	}
+
+	return w.config().State().RedeemInvite(t.Nonce, t.Expires)
+}
+
+// redeemPendingInvite redeems the one-time-use invite this node has joined with.
+// Any refusal stops the node.
+func (w *worker) redeemPendingInvite(ctx context.Context) error {
+
+	token := w.config().State().PendingInvite()
+	if token != "" && w.primary.Load() {
+		err := w.redeemWithRetry(ctx, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (w *worker) redeemWithRetry(ctx context.Context, token string) error {
+	inv, err := invite.Decode(token)
+	if err != nil {
+		return err
+	}
+
+	t := time.NewTicker(rebootstrapInterval)
+	defer t.Stop()
+
+	for {
+		err := w.redeemOnce(ctx, inv.Issuer, token)
+		if errors.Is(err, ErrInviteRefused) {
+			return err
+		} else if err == nil {
+			log.Info("invite redeemed")
+			return w.config().State().SetPendingInvite("")
+		}
+
+		log.
+			With("err", err).
+			Warn("could not redeem invite, will retry")
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (w *worker) redeemOnce(ctx context.Context, issuer peer.ID, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, redeemTimeout)
+	defer cancel()
+
+	s, err := w.host.NewStream(ctx, issuer, invite.Protocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	_ = s.SetDeadline(time.Now().Add(redeemTimeout))
+
+	_, err = io.WriteString(s, token)
+	if err != nil {
+		return err
+	}
+
+	err = s.CloseWrite()
+	if err != nil {
+		return err
+	}
+
+	response, err := bufio.NewReader(io.LimitReader(s, maxTokenSize)).ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	response = strings.TrimSpace(response)
+	if response != redeemAccepted {
+		return fmt.Errorf("%w: %s", ErrInviteRefused, response)
+	}
+
+	return nil
+}
@@ -0,0 +1,367 @@
+package p2p
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/networkstate"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// listenRetries is the number of attempts to take over the listen addr
+// after the PSK rotation: the old host might release it with a delay.
+const listenRetries = 10
+
+// node manages the workers: the primary one and the one started
+// ahead of the PSK rotation.
+type node struct {
+	pk        crypto.PrivKey
+	state     *networkstate.State
+	wgControl Wireguard
+	// cfg might be replaced on reload
+	cfgLock sync.Mutex
+	cfg     *config.Config
+	// workersLock protects primary and next only
+	workersLock sync.RWMutex
+	primary     *worker
+	next        *worker
+	// rotationLock serializes the rotation steps
+	rotationLock sync.Mutex
+	// psk is the PSK currently used, base64-encoded
+	psk string
+	// activation of the next worker
+	activation      time.Time
+	rotationChanged chan struct{}
+	// workers lifecycle
+	ctx  context.Context
+	wg   sync.WaitGroup
+	errs chan error
+}
+
+func (n *node) config() *config.Config {
+	n.cfgLock.Lock()
+	defer n.cfgLock.Unlock()
+
+	return n.cfg
+}
+
+func (n *node) workers() (primary, next *worker) {
+	n.workersLock.RLock()
+	defer n.workersLock.RUnlock()
+
+	return n.primary, n.next
+}
+
+func (n *node) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		n.wg.Wait()
+	}()
+
+	n.rotationLock.Lock()
+	n.ctx = ctx
+	n.start(n.primary)
+	n.rotationLock.Unlock()
+
+	// continue the rotation interrupted by a restart
+	psk, activation := n.config().State().NextPSK()
+	if psk != "" {
+		err := n.scheduleRotation(psk, activation, false)
+		if err != nil {
+			log.
+				With("err", err).
+				Error("could not resume PSK rotation")
+		}
+	}
+
+	n.scheduleConfiguredRotation(n.config())
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-n.errs:
+			return err
+		case <-n.rotationChanged:
+			n.rotationLock.Lock()
+			timer.Stop()
+			if n.next != nil {
+				timer.Reset(time.Until(n.activation))
+			}
+			n.rotationLock.Unlock()
+		case <-timer.C:
+			n.cutover()
+		case <-n.wgControl.Changed():
+			n.Announce(ctx)
+		}
+	}
+}
+
+// start runs the worker until its own context is cancelled.
+func (n *node) start(w *worker) {
+	ctx, cancel := context.WithCancel(n.ctx)
+	w.cancel = cancel
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+
+		err := w.Run(ctx)
+		if ctx.Err() != nil && (err == nil || errors.Is(err, context.Canceled)) {
+			// stopped on purpose
+			return
+		}
+
+		if err == nil {
+			err = fmt.Errorf("p2p: worker stopped unexpectedly")
+		}
+
+		select {
+		case n.errs <- err:
+		default:
+			// already failing
+		}
+	}()
+}
+
+func (n *node) notifyRotationChanged() {
+	select {
+	case n.rotationChanged <- struct{}{}:
+	default:
+		// already notified
+	}
+}
+
+// scheduleConfiguredRotation starts the rotation requested by the operator.
+func (n *node) scheduleConfiguredRotation(cfg *config.Config) {
+	if cfg.P2P.NextPSK == "" {
+		return
+	}
+
+	activation, err := cfg.P2P.NextPSKActivationTime()
+	if err != nil {
+		log.
+			With("err", err).
+			Error("invalid PSK activation time")
+		return
+	}
+
+	// the operator is allowed to replace the pending rotation
+	err = n.scheduleRotation(cfg.P2P.NextPSK, activation, true)
+	if err != nil {
+		log.
+			With("err", err).
+			Error("could not schedule PSK rotation")
+		return
+	}
+
+	primary, _ := n.workers()
+	primary.announceRotation(n.ctx)
+}
+
+// scheduleRotation starts a host for the new PSK which replaces
+// the current one at the activation time. The pending rotation to another PSK
+// is only replaced if requested by the operator of this node.
+func (n *node) scheduleRotation(psk string, activation time.Time, replace bool) error {
+	n.rotationLock.Lock()
+	defer n.rotationLock.Unlock()
+
+	if n.ctx == nil {
+		// not started yet: the rotation is resumed from the state on start
+		return nil
+	}
+
+	if psk == n.psk {
+		// already rotated
+		return nil
+	}
+
+	pending, pendingActivation := n.config().State().NextPSK()
+	if psk == pending && n.next != nil && n.activation.Equal(activation) {
+		// already scheduled
+		return nil
+	}
+
+	if pending != "" && psk != pending && time.Until(pendingActivation) > 0 && !replace {
+		// never decided silently: the operator has to choose one of the PSKs
+		return fmt.Errorf("refusing PSK rotation to %s: rotation to %s is pending until %v, set P2P.NextPSK to the chosen PSK and reload",
+			config.Fingerprint(psk), config.Fingerprint(pending), pendingActivation)
+	}
+
+	if time.Until(activation) <= 0 {
+		return fmt.Errorf("PSK activation time %v has already passed", activation)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(psk)
+	if err != nil {
+		return err
+	}
+
+	listenAddr, err := ephemeralAddr(n.config().P2P.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	err = n.config().State().SetNextPSK(psk, activation)
+	if err != nil {
+		return err
+	}
+
+	log.
+		With("psk", config.Fingerprint(psk)).
+		With("activation", activation).
+		Warn("PSK rotation scheduled, starting a host for the new PSK")
+
+	next := n.newWorker(data, listenAddr.String(), false)
+	n.start(next)
+
+	n.workersLock.Lock()
+	previous := n.next
+	n.next = next
+	n.activation = activation
+	n.workersLock.Unlock()
+
+	if previous != nil {
+		// rotation to another PSK was scheduled before
+		log.
+			With("replaced", config.Fingerprint(pending)).
+			Warn("pending PSK rotation replaced")
+		previous.cancel()
+	}
+
+	n.notifyRotationChanged()
+	return nil
+}
+
+// cutover replaces the primary worker with the one using the new PSK.
+func (n *node) cutover() {
+	n.rotationLock.Lock()
+
+	old, next := n.workers()
+	if next == nil {
+		n.rotationLock.Unlock()
+		return
+	}
+
+	select {
+	case <-next.ready:
+	case <-next.done:
+		// the host for the new PSK failed to start and never becomes ready:
+		// the current PSK is kept, the error is reported by start
+		n.rotationLock.Unlock()
+		return
+	case <-n.ctx.Done():
+		n.rotationLock.Unlock()
+		return
+	}
+
+	log.Warn("activating the new PSK")
+
+	err := n.config().CompletePSKRotation()
+	if err != nil {
+		log.
+			With("err", err).
+			Error("could not save the rotated PSK")
+	}
+
+	n.psk = base64.StdEncoding.EncodeToString(next.psk)
+	n.wgControl.SetNetworkPSK(next.psk)
+
+	n.workersLock.Lock()
+	n.primary, n.next = next, nil
+	n.workersLock.Unlock()
+
+	next.primary.Store(true)
+
+	// old worker might be waiting for the lock
+	n.rotationLock.Unlock()
+
+	// stop the old host and take over its listen addr
+	old.cancel()
+	<-old.done
+
+	addr, err := multiaddr.NewMultiaddr(n.config().P2P.ListenAddr)
+	if err != nil {
+		log.
+			With("err", err).
+			Error("invalid listen addr")
+		return
+	}
+
+	for i := 0; i < listenRetries; i++ {
+		err = next.host.Network().Listen(addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		log.
+			With("addr", addr).
+			With("err", err).
+			Error("could not listen on the configured addr after the PSK rotation")
+	}
+
+	next.updateAddrs()
+	next.announceLocal(n.ctx)
+}
+
+// nextAddrInfo returns the addrs of the host started for the new PSK.
+func (n *node) nextAddrInfo() *peer.AddrInfo {
+	_, next := n.workers()
+	if next == nil {
+		return nil
+	}
+
+	select {
+	case <-next.ready:
+		return &peer.AddrInfo{
+			ID:    next.host.ID(),
+			Addrs: next.host.Addrs(),
+		}
+	default:
+		return nil
+	}
+}
+
+// ephemeralAddr replaces the tcp or udp port of the addr with a random one.
+func ephemeralAddr(addr string) (multiaddr.Multiaddr, error) {
+	parsed, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		components []multiaddr.Multiaddr
+		ferr       error
+	)
+	multiaddr.ForEach(parsed, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_TCP, multiaddr.P_UDP:
+			random, err := multiaddr.NewComponent(c.Protocol().Name, "0")
+			if err != nil {
+				ferr = err
+				return false
+			}
+			components = append(components, random)
+		default:
+			cp := c
+			components = append(components, &cp)
+		}
+		return true
+	})
+
+	return multiaddr.Join(components...), ferr
+}
@@ -5,15 +5,18 @@ import (
 	"time"
 
 	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/invite"
 	"github.com/derlaft/w2wesher/networkstate"
 	"github.com/derlaft/w2wesher/runnergroup"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/pnet"
 	"github.com/multiformats/go-multiaddr"
+	"go.uber.org/atomic"
 	"golang.org/x/sync/semaphore"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -26,23 +29,49 @@ var log = logging.Logger("w2wesher:p2p")
 
 type Node interface {
 	Run(context.Context) error
+	Reload(context.Context, *config.Config)
+	Connections() []network.Conn
+	Announce(context.Context)
+	Reconnect(context.Context)
 }
 
 type Wireguard interface {
 	AnnounceInfo() networkstate.WireguardState
 	Update()
+	// OpenSealed decrypts the data sealed for the wireguard public key.
+	OpenSealed([]byte) ([]byte, error)
+	// Changed notifies about the changes to be announced right away.
+	Changed() <-chan struct{}
+	// SetNetworkPSK replaces the PSK the wireguard preshared keys are derived from.
+	SetNetworkPSK([]byte)
+	// StaticPeers returns the static peers sponsored by this node with the resolved endpoints.
+	StaticPeers() []networkstate.StaticPeer
 }
 
+// worker runs a single libp2p host.
+// Normally there is only one, but during the PSK rotation
+// another one is started for the new PSK.
 type worker struct {
+	node             *node
 	host             host.Host
 	topic            *pubsub.Topic
+	rotationTopic    *pubsub.Topic
 	pubsub           *pubsub.PubSub
 	pk               crypto.PrivKey
 	psk              []byte
+	listenAddr       string
 	state            *networkstate.State
 	wgControl        Wireguard
 	newConnectionSem *semaphore.Weighted
-	cfg              *config.Config
+	// primary is false for the worker waiting for the PSK rotation
+	primary *atomic.Bool
+	// notifies periodicAnnounce about the changed interval
+	intervalChanged chan struct{}
+	// closed once the host and pubsub are started
+	ready chan struct{}
+	// closed once the host is stopped
+	done   chan struct{}
+	cancel context.CancelFunc
 }
 
 func New(cfg *config.Config, state *networkstate.State, wgControl Wireguard) (Node, error) {
@@ -57,14 +86,38 @@ func New(cfg *config.Config, state *networkstate.State, wgControl Wireguard) (No
 		return nil, err
 	}
 
+	n := &node{
+		cfg:             cfg,
+		pk:              pk,
+		psk:             cfg.P2P.PSK,
+		state:           state,
+		wgControl:       wgControl,
+		errs:            make(chan error, 1),
+		rotationChanged: make(chan struct{}, 1),
+	}
+	n.primary = n.newWorker(psk, cfg.P2P.ListenAddr, true)
+
+	return n, nil
+}
+
+func (n *node) newWorker(psk []byte, listenAddr string, primary bool) *worker {
 	return &worker{
-		cfg:              cfg,
-		pk:               pk,
+		node:             n,
+		pk:               n.pk,
 		psk:              psk,
-		state:            state,
-		wgControl:        wgControl,
+		listenAddr:       listenAddr,
+		state:            n.state,
+		wgControl:        n.wgControl,
 		newConnectionSem: semaphore.NewWeighted(maxParallelConnects),
-	}, nil
+		primary:          atomic.NewBool(primary),
+		intervalChanged:  make(chan struct{}, 1),
+		ready:            make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+}
+
+func (w *worker) config() *config.Config {
+	return w.node.config()
 }
 
 func (w *worker) connect(ctx context.Context, p peer.AddrInfo) {
@@ -92,6 +145,11 @@ func (w *worker) connect(ctx context.Context, p peer.AddrInfo) {
 }
 
 func (w *worker) updateAddrs() {
+	if !w.primary.Load() {
+		// connections of the pending host are not used by wireguard
+		return
+	}
+
 	ret := make(map[peer.ID]multiaddr.Multiaddr)
 	n := w.host.Network()
 
@@ -109,15 +167,16 @@ func (w *worker) updateAddrs() {
 }
 
 func (w *worker) Run(ctx context.Context) error {
+	defer close(w.done)
 
-	log.Debug("starting")
+	log.With("listen", w.listenAddr).Debug("starting")
 
 	// make sure it fails on invalid psk
 	pnet.ForcePrivateNetwork = true
 
 	h, err := libp2p.New(
 		libp2p.Identity(w.pk),
-		libp2p.ListenAddrStrings(w.cfg.P2P.ListenAddr),
+		libp2p.ListenAddrStrings(w.listenAddr),
 		libp2p.PrivateNetwork(w.psk),
 		libp2p.EnableNATService(),
 		libp2p.NATPortMap(),
@@ -125,13 +184,20 @@ func (w *worker) Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	defer h.Close()
+
 	w.host = h
 
+	h.SetStreamHandler(invite.Protocol, w.handleRedeem)
+
 	err = w.initializePubsub(ctx)
 	if err != nil {
 		return err
 	}
 
+	// the rotation topic is joined now: announceRotation and cutover can use the worker
+	close(w.ready)
+
 	err = w.initialBootstrap(ctx)
 	if err != nil {
 		return err
@@ -147,5 +213,8 @@ func (w *worker) Run(ctx context.Context) error {
 		Go(w.consumeAnnounces).
 		Go(w.periodicBootstrap).
 		Go(w.sendWelcomeAnnounces).
+		Go(w.redeemPendingInvite).
+		Go(w.consumeRotations).
+		Go(w.periodicRotationAnnounce).
 		Wait()
 }
@@ -32,6 +32,13 @@ func (w *worker) initializePubsub(ctx context.Context) error {
 	}
 	w.topic = topic
 
+	// join PSK rotations
+	rotationTopic, err := ps.Join(w2wesherRotationTopicName)
+	if err != nil {
+		return err
+	}
+	w.rotationTopic = rotationTopic
+
 	return nil
 }
 
@@ -56,6 +63,9 @@ func (w *worker) sendWelcomeAnnounces(ctx context.Context) error {
 			w.updateAddrs()
 		case pubsub.PeerLeave:
 			log.With("id", ev.Peer).Debug("peer left")
+			if w.primary.Load() {
+				w.state.OnLeave(ev.Peer)
+			}
 			w.updateAddrs()
 		}
 	}
@@ -103,6 +113,13 @@ func (w *worker) consumeAnnounces(ctx context.Context) error {
 			return err
 		}
 
+		if !w.primary.Load() {
+			// the host waiting for the PSK rotation only keeps the connections:
+			// the live state is updated by the primary one
+			go w.connect(ctx, a.AddrInfo)
+			continue
+		}
+
 		// notify live state about the change
 		w.state.OnAnnounce(m.ReceivedFrom, a)
 
@@ -118,7 +135,7 @@ func (w *worker) periodicAnnounce(ctx context.Context) error {
 	// make a first announce
 	w.announceLocal(ctx)
 
-	t := time.NewTicker(w.cfg.P2P.AnnounceInterval)
+	t := time.NewTicker(w.config().P2P.AnnounceInterval)
 	defer t.Stop()
 
 	// periodically announce it's own state
@@ -127,6 +144,8 @@ func (w *worker) periodicAnnounce(ctx context.Context) error {
 		case <-t.C:
 			w.announceLocal(ctx)
 			w.updateAddrs()
+		case <-w.intervalChanged:
+			t.Reset(w.config().P2P.AnnounceInterval)
 		case <-ctx.Done():
 			return nil
 		}
@@ -147,6 +166,12 @@ func (w *worker) announceLocal(ctx context.Context) {
 			Addrs: w.host.Addrs(),
 		},
 		WireguardState: w.wgControl.AnnounceInfo(),
+		StaticPeers:    w.wgControl.StaticPeers(),
+	}
+
+	if w.primary.Load() {
+		// let the others connect to the host using the new PSK in advance
+		a.Next = w.node.nextAddrInfo()
 	}
 
 	log.With("announce", a).Debug("going to send announce")
@@ -0,0 +1,72 @@
+package p2p
+
+import (
+	"context"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/exp/slices"
+)
+
+// Reload applies the settings which can be changed without a restart:
+// announce interval, bootstrap peers, static peers and the PSK rotation.
+// The rest of the settings are only used on the next start.
+func (n *node) Reload(ctx context.Context, cfg *config.Config) {
+	n.cfgLock.Lock()
+	old := n.cfg
+	n.cfg = cfg
+	n.cfgLock.Unlock()
+
+	primary, next := n.workers()
+	for _, w := range []*worker{primary, next} {
+		if w != nil && old.P2P.AnnounceInterval != cfg.P2P.AnnounceInterval {
+			w.notifyIntervalChanged()
+		}
+	}
+
+	primary.connectNewBootstrap(ctx, old, cfg)
+
+	n.scheduleConfiguredRotation(cfg)
+}
+
+func (w *worker) notifyIntervalChanged() {
+	select {
+	case w.intervalChanged <- struct{}{}:
+	default:
+		// already notified
+	}
+}
+
+func (w *worker) connectNewBootstrap(ctx context.Context, old, cfg *config.Config) {
+	select {
+	case <-w.ready:
+	default:
+		// not started yet: bootstrap peers will be loaded on start
+		return
+	}
+
+	bootstrap, err := cfg.LoadBootstrapPeers()
+	if err != nil {
+		log.
+			With("err", err).
+			Error("could not load bootstrap peers")
+		return
+	}
+
+	for _, ai := range bootstrap {
+		if ai.ID == w.host.ID() {
+			continue
+		}
+
+		addrs, _ := peer.AddrInfoToP2pAddrs(&ai)
+		known := false
+		for _, addr := range addrs {
+			known = known || slices.Contains(old.P2P.Bootstrap, addr.String())
+		}
+
+		if !known {
+			log.With("addr", ai).Info("connecting to the new bootstrap peer")
+			go w.connect(ctx, ai)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/exp/slices"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const w2wesherRotationTopicName = "w2w:psk-rotation"
+
+// rotationSignaturePrefix separates the rotation signatures from the other uses of the libp2p key.
+const rotationSignaturePrefix = "w2wesher PSK rotation:"
+
+// rotation announces the new network PSK.
+// Knowing the current PSK is not enough to start the rotation:
+// the rotation is only accepted from the nodes listed in P2P.RotationSigners.
+type rotation struct {
+	// Activation is the unix time of the switch to the new PSK
+	Activation int64 `json:"at"`
+	// Keys contains the new PSK sealed for each member's wireguard public key
+	Keys map[string][]byte `json:"keys"`
+}
+
+// signedRotation is the encoded rotation signed by the libp2p key of the initiator.
+type signedRotation struct {
+	Rotation []byte `json:"rotation"`
+	// Signer is the peer ID of the initiator, its public key is used for the verification
+	Signer    string `json:"signer"`
+	Signature []byte `json:"sig"`
+}
+
+// announceRotation sends the new PSK requested by the operator to all the known members.
+func (w *worker) announceRotation(ctx context.Context) {
+	if !w.primary.Load() {
+		return
+	}
+
+	select {
+	case <-w.ready:
+	default:
+		// will be announced periodically once started
+		return
+	}
+
+	cfg := w.config()
+	psk, activation := cfg.State().NextPSK()
+	if psk == "" || psk != cfg.P2P.NextPSK || time.Until(activation) <= 0 {
+		// rotation is not initiated by this node or is already completed
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(psk)
+	if err != nil {
+		log.
+			With("err", err).
+			Error("invalid next PSK")
+		return
+	}
+
+	r := rotation{
+		Activation: activation.Unix(),
+		Keys:       make(map[string][]byte),
+	}
+
+	for _, info := range w.state.Snapshot() {
+		ws := info.LastAnnounce.WireguardState
+		if !ws.IsValid() {
+			continue
+		}
+
+		pub, err := wgtypes.ParseKey(ws.PublicKey)
+		if err != nil {
+			continue
+		}
+
+		var recipient = [32]byte(pub)
+		sealed, err := box.SealAnonymous(nil, data, &recipient, rand.Reader)
+		if err != nil {
+			log.
+				With("err", err).
+				Error("could not seal the next PSK")
+			return
+		}
+
+		r.Keys[ws.PublicKey] = sealed
+	}
+
+	msg, err := w.signRotation(r)
+	if err != nil {
+		log.
+			With("err", err).
+			Error("could not encode PSK rotation")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, announceTimeout)
+	defer cancel()
+
+	log.
+		With("members", len(r.Keys)).
+		Info("announcing PSK rotation")
+
+	err = w.rotationTopic.Publish(ctx, msg)
+	if err != nil {
+		log.
+			With("err", err).
+			Error("could not publish PSK rotation")
+	}
+}
+
+// signRotation encodes the rotation signed by the libp2p key of this node.
+func (w *worker) signRotation(r rotation) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := w.pk.Sign(append([]byte(rotationSignaturePrefix), data...))
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return json.Marshal(signedRotation{
+		Rotation:  data,
+		Signer:    w.host.ID().String(),
+		Signature: sig,
+	})
+}
+
+// verifyRotation returns the encoded rotation if it is signed by one of P2P.RotationSigners.
+func (w *worker) verifyRotation(data []byte) ([]byte, peer.ID, error) {
+	var s signedRotation
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding: %w", err)
+	}
+
+	signer, err := peer.Decode(s.Signer)
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding signer: %w", err)
+	}
+
+	signers, err := w.config().P2P.RotationSignerIDs()
+	if err != nil {
+		return nil, signer, err
+	}
+
+	if !slices.Contains(signers, signer) {
+		return nil, signer, fmt.Errorf("signer is not listed in P2P.RotationSigners")
+	}
+
+	key, err := signer.ExtractPublicKey()
+	if err != nil {
+		return nil, signer, fmt.Errorf("extracting signer key: %w", err)
+	}
+
+	ok, err := key.Verify(append([]byte(rotationSignaturePrefix), s.Rotation...), s.Signature)
+	if err != nil {
+		return nil, signer, fmt.Errorf("verifying signature: %w", err)
+	}
+	if !ok {
+		return nil, signer, fmt.Errorf("invalid signature")
+	}
+
+	return s.Rotation, signer, nil
+}
+
+func (w *worker) periodicRotationAnnounce(ctx context.Context) error {
+
+	t := time.NewTicker(w.config().P2P.AnnounceInterval)
+	defer t.Stop()
+
+	// new members might appear, old ones might miss the message:
+	// repeat the announce until the activation
+	for {
+		select {
+		case <-t.C:
+			w.announceRotation(ctx)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (w *worker) consumeRotations(ctx context.Context) error {
+
+	sub, err := w.rotationTopic.Subscribe()
+	if err != nil {
+		log.
+			With("err", err).
+			Error("failed to subscribe to PSK rotations")
+		return err
+	}
+
+	for {
+		m, err := sub.Next(ctx)
+		if err != nil {
+
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+
+			log.
+				With("err", err).
+				Error("could not consume a message")
+			return err
+		}
+
+		if m.ReceivedFrom == w.host.ID() {
+			continue
+		}
+
+		data, signer, err := w.verifyRotation(m.Message.Data)
+		if err != nil {
+			log.
+				With("from", m.ReceivedFrom).
+				With("signer", signer).
+				With("err", err).
+				Error("refusing PSK rotation")
+			continue
+		}
+
+		err = w.onRotation(data)
+		if err != nil {
+			log.
+				With("from", m.ReceivedFrom).
+				With("signer", signer).
+				With("err", err).
+				Error("could not process PSK rotation")
+		}
+	}
+}
+
+func (w *worker) onRotation(data []byte) error {
+	var r rotation
+	err := json.Unmarshal(data, &r)
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+
+	sealed, ok := r.Keys[w.wgControl.AnnounceInfo().PublicKey]
+	if !ok {
+		return fmt.Errorf("PSK was not sealed for this node")
+	}
+
+	psk, err := w.wgControl.OpenSealed(sealed)
+	if err != nil {
+		return fmt.Errorf("opening the sealed PSK: %w", err)
+	}
+
+	if len(psk) != len(w.psk) {
+		return fmt.Errorf("invalid PSK length %d", len(psk))
+	}
+
+	return w.node.scheduleRotation(base64.StdEncoding.EncodeToString(psk), time.Unix(r.Activation, 0), false)
+}
@@ -61,3 +61,21 @@ func AbortOnSignal(ctx context.Context) error {
 
 	return ctx.Err()
 }
+
+// OnSignal returns a runner which calls fn every time one of the signals is received.
+func OnSignal(fn func(context.Context), signals ...os.Signal) func(context.Context) error {
+	return func(ctx context.Context) error {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, signals...)
+		defer signal.Stop(sigs)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-sigs:
+				fn(ctx)
+			}
+		}
+	}
+}
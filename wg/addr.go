@@ -5,7 +5,9 @@ import (
 	"hash/fnv"
 	"net"
 	"net/netip"
-	"os"
+	"time"
+
+	"github.com/derlaft/w2wesher/networkstate"
 )
 
 func addrToIPNet(addr netip.Addr) *net.IPNet {
@@ -23,35 +25,144 @@ func prefixToIPNet(p netip.Prefix) *net.IPNet {
 	}
 }
 
-// assignOverlayAddr assigns a new address to the interface.
-// The address is assigned inside the provided network and depends on the
-// provided name deterministically.
-// Currently, the address is assigned by hashing the name and mapping that
-// hash in the target network space.
-func (s *State) assignOverlayAddr(nodeName string) error {
+func ipNetToPrefix(n net.IPNet) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(n.IP)
+	bits, _ := n.Mask.Size()
+	if addr.Is4In6() && bits > 32 {
+		bits -= 96
+	}
+	return netip.PrefixFrom(addr.Unmap(), bits)
+}
+
+// assignOverlayAddr proposes the new addresses for the interface.
+// See OverlayAddr, the salt changes them after losing an address conflict.
+func (s *State) assignOverlayAddr() error {
+
+	addr, addr4, err := s.candidateAddrs(s.addrSalt)
+	if err != nil {
+		return err
+	}
+
+	log.
+		With("addr", addr).
+		With("addr4", addr4).
+		Debug("proposing overlay address")
+
+	s.setOverlayAddrs(addr, addr4, networkstate.ClaimProposed)
+	s.proposedAt = time.Now()
+
+	return nil
+}
+
+// candidateAddrs returns the addresses derived from the node name and the salt.
+func (s *State) candidateAddrs(salt int) (netip.Addr, netip.Addr, error) {
+
+	name := saltedName(s.nodeName, salt)
+
+	addr, err := OverlayAddr(s.overlayPrefix, name)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
 
-	if nodeName == "" {
-		nodeName, _ = os.Hostname()
+	var addr4 netip.Addr
+	if s.overlayPrefix4.IsValid() {
+		addr4, err = OverlayAddr(s.overlayPrefix4, name)
+		if err != nil {
+			return netip.Addr{}, netip.Addr{}, err
+		}
 	}
 
-	ip := s.overlayPrefix.Addr().AsSlice()
+	return addr, addr4, nil
+}
+
+func (s *State) setOverlayAddrs(addr, addr4 netip.Addr, claim string) {
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+
+	s.overlayAddr, s.overlayAddr4 = addr, addr4
+	s.claim = claim
+}
+
+// overlayAddrs returns the overlay addresses of this node,
+// the IPv4 one is invalid unless configured.
+func (s *State) overlayAddrs() (netip.Addr, netip.Addr) {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	return s.overlayAddr, s.overlayAddr4
+}
+
+// saltedName is hashed instead of the node name after the salt is chosen.
+func saltedName(nodeName string, salt int) string {
+	if salt == 0 {
+		return nodeName
+	}
+	return fmt.Sprintf("%s#%d", nodeName, salt)
+}
+
+// OverlayAddr returns the address of the node inside the provided network.
+// The address depends on the provided name deterministically.
+// Currently, the address is assigned by hashing the name and mapping
+// the last bits of that hash to the host bits of the target network.
+// IPv4 network and broadcast addresses are never returned.
+func OverlayAddr(prefix netip.Prefix, nodeName string) (netip.Addr, error) {
 
 	h := fnv.New128a()
 	h.Write([]byte(nodeName))
-	hb := h.Sum(nil)
 
-	for i := 1; i <= (s.overlayPrefix.Addr().BitLen()-s.overlayPrefix.Bits())/8; i++ {
-		ip[len(ip)-i] = hb[len(hb)-i]
+	return mapHash(prefix, h.Sum(nil))
+}
+
+// mapHash replaces the host bits of the prefix with the last bits of the hash.
+func mapHash(prefix netip.Prefix, hash []byte) (netip.Addr, error) {
+
+	ip := prefix.Masked().Addr().AsSlice()
+	hostBits := len(ip)*8 - prefix.Bits()
+
+	if hostBits > len(hash)*8 {
+		return netip.Addr{}, fmt.Errorf("network %s is too large", prefix)
+	}
+
+	for i := 0; i < hostBits; i++ {
+		// i-th bit from the end
+		var (
+			byteIdx = i / 8
+			mask    = byte(1) << (i % 8)
+		)
+
+		if hash[len(hash)-1-byteIdx]&mask != 0 {
+			ip[len(ip)-1-byteIdx] |= mask
+		}
 	}
 
 	addr, ok := netip.AddrFromSlice(ip)
 	if !ok {
-		return fmt.Errorf("could not create IP from %q", ip)
+		return netip.Addr{}, fmt.Errorf("could not create IP from %q", ip)
 	}
 
-	log.With("addr", addr).Debug("assigned overlay address")
+	if addr.Is4() && hostBits > 1 {
+		switch addr {
+		case prefix.Masked().Addr():
+			// network address
+			addr = addr.Next()
+		case lastAddr(prefix):
+			// broadcast address
+			addr = addr.Prev()
+		}
+	}
 
-	s.overlayAddr = addr
+	return addr, nil
+}
 
-	return nil
+// lastAddr returns the last address of the prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	ip := prefix.Masked().Addr().AsSlice()
+	hostBits := len(ip)*8 - prefix.Bits()
+
+	for i := 0; i < hostBits; i++ {
+		ip[len(ip)-1-i/8] |= byte(1) << (i % 8)
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr
 }
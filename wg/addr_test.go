@@ -0,0 +1,147 @@
+package wg
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestMapHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  string
+		hash    []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "ipv4 host bits from the end of the hash",
+			prefix: "10.0.0.0/8",
+			hash:   []byte{0xff, 0x12, 0x34, 0x56},
+			want:   "10.18.52.86",
+		},
+		{
+			name:   "partial byte",
+			prefix: "10.77.0.0/20",
+			hash:   []byte{0xff, 0xff, 0xab, 0xcd},
+			want:   "10.77.11.205",
+		},
+		{
+			name:   "ipv6",
+			prefix: "fd6d:142e:65e7:4cc1::/64",
+			hash:   []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5, 6, 7, 8},
+			want:   "fd6d:142e:65e7:4cc1:102:304:506:708",
+		},
+		{
+			name:   "unmasked prefix",
+			prefix: "10.77.1.2/16",
+			hash:   []byte{0x12, 0x34},
+			want:   "10.77.18.52",
+		},
+		{
+			name:   "ipv4 network address is skipped",
+			prefix: "10.77.0.0/16",
+			hash:   []byte{0xff, 0x00, 0x00},
+			want:   "10.77.0.1",
+		},
+		{
+			name:   "ipv4 broadcast address is skipped",
+			prefix: "10.77.0.0/16",
+			hash:   []byte{0x00, 0xff, 0xff},
+			want:   "10.77.255.254",
+		},
+		{
+			name:   "ipv4 /31 has no network and broadcast addresses",
+			prefix: "10.77.0.0/31",
+			hash:   []byte{0x00},
+			want:   "10.77.0.0",
+		},
+		{
+			name:   "ipv6 network address is kept",
+			prefix: "fd00::/120",
+			hash:   []byte{0x00},
+			want:   "fd00::",
+		},
+		{
+			name:   "single address",
+			prefix: "10.77.0.5/32",
+			hash:   []byte{0xff},
+			want:   "10.77.0.5",
+		},
+		{
+			name:    "network larger than the hash",
+			prefix:  "fd00::/64",
+			hash:    []byte{1, 2, 3, 4},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mapHash(netip.MustParsePrefix(tt.prefix), tt.hash)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("mapHash() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mapHash() error = %v", err)
+			}
+
+			if got != netip.MustParseAddr(tt.want) {
+				t.Errorf("mapHash() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastAddr(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"10.77.0.0/16", "10.77.255.255"},
+		{"10.77.0.0/20", "10.77.15.255"},
+		{"10.77.1.2/24", "10.77.1.255"},
+		{"10.77.0.5/32", "10.77.0.5"},
+		{"fd00::/64", "fd00::ffff:ffff:ffff:ffff"},
+		{"0.0.0.0/0", "255.255.255.255"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got := lastAddr(netip.MustParsePrefix(tt.prefix))
+			if got != netip.MustParseAddr(tt.want) {
+				t.Errorf("lastAddr() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOverlayAddr pins the addresses: changing the mapping re-addresses every node.
+func TestOverlayAddr(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		want   string
+	}{
+		{"fd6d:142e:65e7:4cc1::/64", "node1", "fd6d:142e:65e7:4cc1:7081:2bd0:6e3b:493c"},
+		{"fd6d:142e:65e7:4cc1::/64", "alpha", "fd6d:142e:65e7:4cc1:7081:448b:c656:696b"},
+		{"10.77.0.0/16", "node1", "10.77.73.60"},
+		{"10.77.0.0/16", "alpha", "10.77.105.107"},
+		{"fd6d:142e:65e7:4cc1::/64", saltedName("node1", 1), "fd6d:142e:65e7:4cc1:826f:4635:80f8:7b9c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix+"/"+tt.name, func(t *testing.T) {
+			got, err := OverlayAddr(netip.MustParsePrefix(tt.prefix), tt.name)
+			if err != nil {
+				t.Fatalf("OverlayAddr() error = %v", err)
+			}
+
+			if got != netip.MustParseAddr(tt.want) {
+				t.Errorf("OverlayAddr() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
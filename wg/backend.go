@@ -0,0 +1,281 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Link is the desired state of the wireguard interface.
+type Link struct {
+	Name  string
+	Addrs []netip.Addr
+	MTU   int
+}
+
+// Route is the desired route via the wireguard interface.
+type Route struct {
+	Link string
+	Dst  netip.Prefix
+}
+
+// ExitPolicy routes all the traffic except the listed destinations via the link.
+// The policy without Dsts is removed.
+type ExitPolicy struct {
+	Link string
+	// Table holds the default routes via the link
+	Table int
+	// Mark is set on the wireguard packets, they are never routed via the table
+	Mark int
+	// Dsts are the default routes of the families routed via the link
+	Dsts []netip.Prefix
+	// Bypass are reached without the link: the endpoints of the peers
+	Bypass []netip.Addr
+}
+
+// Masquerade forwards the traffic of the Sources from the link to the other interfaces.
+// Masquerade without Sources is removed.
+type Masquerade struct {
+	Link    string
+	Sources []netip.Prefix
+}
+
+// Backend applies the computed configuration to the system.
+type Backend interface {
+	// LinkUp creates the interface if needed, sets its addrs and MTU and brings it up.
+	LinkUp(Link) error
+	// RouteAdd adds the route, existing routes are kept.
+	RouteAdd(Route) error
+	// RouteDel removes the route, missing routes are ignored.
+	RouteDel(Route) error
+	// ConfigureDevice applies the wireguard configuration.
+	ConfigureDevice(iface string, cfg wgtypes.Config) error
+	// LinkDown removes the interface.
+	LinkDown(iface string) error
+	// Device returns the current state of the wireguard interface.
+	Device(iface string) (*wgtypes.Device, error)
+	// PathMTU returns the MTU of the route towards dst.
+	PathMTU(dst netip.Addr) (int, error)
+	// ConnectedRoutes returns the directly connected networks of the links except the excluded one.
+	ConnectedRoutes(exclude string) ([]netip.Prefix, error)
+	// SetExitPolicy installs or removes the policy routing via the exit node.
+	SetExitPolicy(ExitPolicy) error
+	// SetMasquerade enables the forwarding and the masquerading of the exit node.
+	SetMasquerade(Masquerade) error
+}
+
+// netlinkBackend manages the kernel wireguard interface.
+type netlinkBackend struct {
+	client *wgctrl.Client
+	// masquerade lists the iptables rules added by the backend
+	masquerade map[string]iptablesRule
+}
+
+// NewBackend returns the backend managing the kernel interface.
+func NewBackend() (Backend, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("instantiating wireguard client: %w", err)
+	}
+
+	return &netlinkBackend{
+		client:     client,
+		masquerade: make(map[string]iptablesRule),
+	}, nil
+}
+
+func (b *netlinkBackend) LinkUp(l Link) error {
+	if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: l.Name}}); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("creating link %s: %w", l.Name, err)
+	}
+
+	link, err := netlink.LinkByName(l.Name)
+	if err != nil {
+		return fmt.Errorf("getting link information for %s: %w", l.Name, err)
+	}
+
+	for _, addr := range l.Addrs {
+		if err := netlink.AddrReplace(link, &netlink.Addr{
+			IPNet: addrToIPNet(addr),
+		}); err != nil {
+			return fmt.Errorf("setting address %s for %s: %w", addr, l.Name, err)
+		}
+	}
+
+	// the interface is owned by w2wesher: the addresses given up after a conflict are removed
+	stale, err := staleAddrs(link, l.Addrs)
+	if err != nil {
+		return fmt.Errorf("listing addresses of %s: %w", l.Name, err)
+	}
+
+	for _, addr := range stale {
+		if err := netlink.AddrDel(link, &addr); err != nil {
+			return fmt.Errorf("removing address %s from %s: %w", addr.IPNet, l.Name, err)
+		}
+	}
+
+	if err := netlink.LinkSetMTU(link, l.MTU); err != nil {
+		return fmt.Errorf("setting MTU for %s: %w", l.Name, err)
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("enabling interface %s: %w", l.Name, err)
+	}
+
+	return nil
+}
+
+func (b *netlinkBackend) RouteAdd(r Route) error {
+	link, err := netlink.LinkByName(r.Link)
+	if err != nil {
+		return fmt.Errorf("getting link information for %s: %w", r.Link, err)
+	}
+
+	if err := netlink.RouteAdd(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       prefixToIPNet(r.Dst),
+		Scope:     netlink.SCOPE_LINK,
+	}); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("adding route: %w", err)
+	}
+
+	return nil
+}
+
+func (b *netlinkBackend) RouteDel(r Route) error {
+	link, err := netlink.LinkByName(r.Link)
+	if err != nil {
+		return fmt.Errorf("getting link information for %s: %w", r.Link, err)
+	}
+
+	if err := netlink.RouteDel(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       prefixToIPNet(r.Dst),
+		Scope:     netlink.SCOPE_LINK,
+	}); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("removing route: %w", err)
+	}
+
+	return nil
+}
+
+func (b *netlinkBackend) ConfigureDevice(iface string, cfg wgtypes.Config) error {
+	return b.client.ConfigureDevice(iface, cfg)
+}
+
+func (b *netlinkBackend) LinkDown(iface string) error {
+	_, err := b.client.Device(iface)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// device already gone; noop
+			return nil
+		}
+
+		return fmt.Errorf("getting device %s: %w", iface, err)
+	}
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("getting link for %s: %w", iface, err)
+	}
+
+	return netlink.LinkDel(link)
+}
+
+func (b *netlinkBackend) Device(iface string) (*wgtypes.Device, error) {
+	return b.client.Device(iface)
+}
+
+func (b *netlinkBackend) PathMTU(dst netip.Addr) (int, error) {
+	return routeMTU(dst)
+}
+
+func (b *netlinkBackend) ConnectedRoutes(exclude string) ([]netip.Prefix, error) {
+	return connectedRoutes(exclude)
+}
+
+// connectedRoutes lists the link scope routes of the main table.
+func connectedRoutes(exclude string) ([]netip.Prefix, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("listing routes: %w", err)
+	}
+
+	var connected []netip.Prefix
+	for _, route := range routes {
+		if route.Dst == nil || route.Scope != netlink.SCOPE_LINK {
+			continue
+		}
+
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err == nil && link.Attrs().Name == exclude {
+			continue
+		}
+
+		dst := ipNetToPrefix(*route.Dst)
+		if dst.Addr().IsLinkLocalUnicast() {
+			continue
+		}
+
+		connected = append(connected, dst)
+	}
+
+	return connected, nil
+}
+
+// routeMTU looks up the route towards dst: its own MTU metric is used if set,
+// otherwise the MTU of the outgoing link.
+func routeMTU(dst netip.Addr) (int, error) {
+	routes, err := netlink.RouteGet(dst.AsSlice())
+	if err != nil {
+		return 0, fmt.Errorf("getting route to %s: %w", dst, err)
+	}
+
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("no route to %s", dst)
+	}
+
+	if routes[0].MTU > 0 {
+		return routes[0].MTU, nil
+	}
+
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return 0, fmt.Errorf("getting link of the route to %s: %w", dst, err)
+	}
+
+	return link.Attrs().MTU, nil
+}
+
+// staleAddrs returns the addresses of the link which are not wanted, except the link-local ones.
+func staleAddrs(link netlink.Link, want []netip.Addr) ([]netlink.Addr, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []netlink.Addr
+	for _, addr := range addrs {
+		ip, ok := netip.AddrFromSlice(addr.IP)
+		if !ok || ip.IsLinkLocalUnicast() {
+			continue
+		}
+
+		found := false
+		for _, w := range want {
+			found = found || w == ip.Unmap()
+		}
+
+		if !found {
+			stale = append(stale, addr)
+		}
+	}
+
+	return stale, nil
+}
@@ -0,0 +1,144 @@
+package wg
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/derlaft/w2wesher/networkstate"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// maxSaltAttempts limits the search for the free addresses.
+const maxSaltAttempts = 1000
+
+// resolveConflicts chooses new addresses for this node if it has lost an address conflict.
+// The conflicting addresses of the other losers are returned: they are not installed,
+// so the traffic of the winner is never stolen.
+func (s *State) resolveConflicts() (map[peer.ID]map[string]bool, error) {
+	var (
+		excluded = make(map[peer.ID]map[string]bool)
+		reported = make(map[string]bool)
+		lost     = false
+	)
+
+	for _, c := range s.state.Conflicts(s.selfID, s.AnnounceInfo(), s.leaseExpiry) {
+		key := c.Addr + " " + fmt.Sprint(c.Peers)
+		reported[key] = true
+		switch {
+		case s.conflicts[key]:
+			// already reported
+		case c.Unresolved:
+			log.
+				With("addr", c.Addr).
+				With("peers", c.Peers).
+				Error("overlay address is pinned by several peers, nobody keeps it: fix Wireguard.Address")
+		default:
+			log.
+				With("addr", c.Addr).
+				With("winner", c.Winner()).
+				With("losers", c.Losers()).
+				Error("overlay address conflict detected")
+		}
+
+		for _, id := range c.Losers() {
+			if id == s.selfID {
+				lost = true
+				continue
+			}
+
+			if excluded[id] == nil {
+				excluded[id] = make(map[string]bool)
+			}
+			excluded[id][c.Addr] = true
+		}
+	}
+	s.conflicts = reported
+
+	if !lost {
+		return excluded, nil
+	}
+
+	return excluded, s.readdress()
+}
+
+// readdress moves this node to the next salted addresses not claimed by the others.
+func (s *State) readdress() error {
+	old, _ := s.overlayAddrs()
+
+	if s.claimed() == networkstate.ClaimPinned {
+		log.
+			With("addr", old).
+			Error("lost the conflict for the pinned overlay address, fix Wireguard.Address")
+		return nil
+	}
+
+	salt, err := s.freeSalt()
+	if err != nil {
+		return err
+	}
+
+	s.addrSalt = salt
+	err = s.cfg.State().SetAddrSalt(s.nodeName, s.addrSalt)
+	if err != nil {
+		return fmt.Errorf("saving address salt: %w", err)
+	}
+
+	err = s.assignOverlayAddr()
+	if err != nil {
+		return fmt.Errorf("assigning overlay address: %w", err)
+	}
+
+	// the lost lease is not valid anymore
+	err = s.cfg.State().SetLease("", "", time.Time{})
+	if err != nil {
+		return fmt.Errorf("dropping lease: %w", err)
+	}
+
+	addr, _ := s.overlayAddrs()
+	log.
+		With("old", old).
+		With("new", addr).
+		With("salt", s.addrSalt).
+		Error("lost the overlay address conflict, changing the address of this node")
+
+	err = s.InterfaceUp()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.readdressed <- struct{}{}:
+	default:
+		// already notified
+	}
+	s.notifyChanged()
+
+	return nil
+}
+
+// freeSalt finds the next salt giving the addresses not claimed by the live peers.
+func (s *State) freeSalt() (int, error) {
+	claimed := make(map[netip.Addr]bool)
+	for _, info := range s.state.Live(s.leaseExpiry) {
+		ws := info.LastAnnounce.WireguardState
+		for _, raw := range []string{ws.SelectedAddr, ws.SelectedAddr4} {
+			if addr, err := netip.ParseAddr(raw); err == nil {
+				claimed[addr.Unmap()] = true
+			}
+		}
+	}
+
+	for salt := s.addrSalt + 1; salt <= s.addrSalt+maxSaltAttempts; salt++ {
+		addr, addr4, err := s.candidateAddrs(salt)
+		if err != nil {
+			return 0, err
+		}
+
+		if !claimed[addr] && !claimed[addr4] {
+			return salt, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free overlay address found in %d attempts", maxSaltAttempts)
+}
@@ -0,0 +1,171 @@
+package wg
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/networkstate"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// ExitTable holds the default routes via the exit node.
+	// It differs from the one of wg-quick (51820), so both can be used on the same host.
+	ExitTable = 0x7732
+	// ExitMark is set on the wireguard packets, so they never loop into the tunnel.
+	ExitMark = 0x7732
+)
+
+var (
+	defaultRoute4 = netip.MustParsePrefix("0.0.0.0/0")
+	defaultRoute6 = netip.MustParsePrefix("::/0")
+)
+
+// exitRoutes returns the selected exit node and the default routes allowed for it,
+// none if it does not announce itself as an exit node.
+func (s *State) exitRoutes(nodes []networkstate.Info) (peer.ID, []netip.Prefix) {
+	s.keyLock.RLock()
+	selected := s.cfg.ExitNode()
+	s.keyLock.RUnlock()
+
+	if selected == "" {
+		return "", nil
+	}
+
+	id, err := peer.Decode(selected)
+	if err != nil {
+		log.
+			With("exit", selected).
+			With("err", err).
+			Warn("invalid exit node")
+		return "", nil
+	}
+
+	if !s.overlayPrefix4.IsValid() {
+		// the exit node only accepts the sources inside the overlay networks:
+		// without NetworkRange4 the IPv4 traffic would silently bypass it
+		if !s.exitRefused {
+			log.
+				With("exit", id).
+				Error("exit node requires NetworkRange4, not routing the traffic via it")
+		}
+		s.exitRefused = true
+		return id, nil
+	}
+	s.exitRefused = false
+
+	for _, node := range nodes {
+		as := node.LastAnnounce.WireguardState
+		if node.ID != id || node.ID == s.selfID || !as.IsValid() || !as.ExitNode || s.expired(node) {
+			continue
+		}
+
+		return id, []netip.Prefix{defaultRoute6, defaultRoute4}
+	}
+
+	return id, nil
+}
+
+// syncExitPolicy routes all the traffic via the exit node if it is available.
+// The endpoints of the peers are bypassed, so the libp2p connections
+// never go via the tunnel they control.
+func (s *State) syncExitPolicy(nodes []networkstate.Info, exit peer.ID, routes []netip.Prefix) error {
+	if len(routes) == 0 && !s.exitActive.Load() && s.exitSynced {
+		// nothing to install or remove
+		return nil
+	}
+
+	var bypass []netip.Addr
+	if len(routes) > 0 {
+		for _, node := range nodes {
+			addr, err := netip.ParseAddr(node.Addr)
+			if err == nil {
+				bypass = append(bypass, addr)
+			}
+		}
+	}
+
+	err := s.backend.SetExitPolicy(ExitPolicy{
+		Link:   s.iface,
+		Table:  ExitTable,
+		Mark:   ExitMark,
+		Dsts:   routes,
+		Bypass: bypass,
+	})
+	if err != nil {
+		return fmt.Errorf("setting exit node policy: %w", err)
+	}
+
+	active := len(routes) > 0
+	switch {
+	case active && !s.exitActive.Load():
+		log.With("exit", exit).Info("routing all the traffic via the exit node")
+	case !active && s.exitActive.Load() && exit != "":
+		log.With("exit", exit).Warn("exit node is not available, routing the traffic directly")
+	case !active && s.exitActive.Load():
+		log.Info("not routing the traffic via the exit node anymore")
+	}
+	s.exitActive.Store(active)
+	s.exitSynced = true
+
+	return nil
+}
+
+// masquerade sets up the forwarding of the overlay networks on the exit node.
+func (s *State) masquerade() error {
+	if !s.exitMasquerade {
+		return nil
+	}
+
+	m := Masquerade{
+		Link:    s.iface,
+		Sources: []netip.Prefix{s.overlayPrefix},
+	}
+	if s.overlayPrefix4.IsValid() {
+		m.Sources = append(m.Sources, s.overlayPrefix4)
+	}
+
+	err := s.backend.SetMasquerade(m)
+	if err != nil {
+		return fmt.Errorf("setting exit node masquerade: %w", err)
+	}
+
+	return nil
+}
+
+// SelectExitNode changes the exit node in use and saves it to the state file:
+// a peer ID, config.ExitNodeOff or empty to follow the config.
+func (s *State) SelectExitNode(exit string) error {
+	if exit != "" && exit != config.ExitNodeOff {
+		_, err := peer.Decode(exit)
+		if err != nil {
+			return fmt.Errorf("parsing exit node: %w", err)
+		}
+
+		if !s.overlayPrefix4.IsValid() {
+			return fmt.Errorf("exit node requires NetworkRange4, otherwise the IPv4 traffic bypasses it")
+		}
+	}
+
+	s.keyLock.RLock()
+	cfg := s.cfg
+	s.keyLock.RUnlock()
+
+	err := cfg.State().SetExitNode(exit)
+	if err != nil {
+		return fmt.Errorf("saving exit node: %w", err)
+	}
+
+	s.Update()
+	return nil
+}
+
+// ExitNode returns the selected exit node and whether the traffic is routed via it.
+func (s *State) ExitNode() (string, bool) {
+	s.keyLock.RLock()
+	selected := s.cfg.ExitNode()
+	s.keyLock.RUnlock()
+
+	return selected, s.exitActive.Load()
+}
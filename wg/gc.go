@@ -0,0 +1,107 @@
+package wg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// outageAnnounces is the number of announce intervals without any announces
+// considered a libp2p outage: the peers are kept until the announces are back.
+const outageAnnounces = 3
+
+// recordHandshakes saves the last handshakes of the mesh members to the network state.
+func (s *State) recordHandshakes() {
+	device, err := s.backend.Device(s.iface)
+	if err != nil {
+		log.With("err", err).Debug("could not read wireguard handshakes")
+		return
+	}
+
+	byKey := make(map[wgtypes.Key]peer.ID)
+	for id, keys := range s.installedMembers {
+		for _, key := range keys {
+			byKey[key] = id
+		}
+	}
+
+	handshakes := make(map[peer.ID]time.Time)
+	for _, dp := range device.Peers {
+		id, ok := byKey[dp.PublicKey]
+		if ok && dp.LastHandshakeTime.After(handshakes[id]) {
+			handshakes[id] = dp.LastHandshakeTime
+		}
+	}
+
+	s.state.UpdateHandshakes(handshakes)
+}
+
+// removeDeparted removes the mesh members not heard of for PeerTTL
+// from the network state and from the device.
+func (s *State) removeDeparted() error {
+	if s.peerTTL <= 0 {
+		// disabled
+		return nil
+	}
+
+	s.recordHandshakes()
+
+	var (
+		nodes  = s.state.Snapshot()
+		latest time.Time
+	)
+
+	for _, node := range nodes {
+		if node.LastSeen.After(latest) {
+			latest = node.LastSeen
+		}
+	}
+
+	if time.Since(latest) > outageAnnounces*s.cfg.P2P.AnnounceInterval {
+		// nothing is announced: the control plane is down, not the peers
+		log.Debug("no recent announces, keeping the peers")
+		return nil
+	}
+
+	var removed []wgtypes.PeerConfig
+	for _, node := range nodes {
+		if node.LastSeen.IsZero() {
+			// connected, but not a wireguard peer yet
+			continue
+		}
+
+		if time.Since(node.LastActive()) < s.peerTTL {
+			continue
+		}
+
+		log.
+			With("peer", node.ID).
+			With("last_active", node.LastActive()).
+			Warn("removing the departed peer")
+
+		s.state.Remove(node.ID)
+		for _, key := range s.installedMembers[node.ID] {
+			removed = append(removed, wgtypes.PeerConfig{
+				PublicKey: key,
+				Remove:    true,
+			})
+		}
+		delete(s.installedMembers, node.ID)
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	err := s.backend.ConfigureDevice(s.iface, wgtypes.Config{
+		Peers: removed,
+	})
+	if err != nil {
+		return fmt.Errorf("removing departed peers from %s: %w", s.iface, err)
+	}
+
+	// the static peers sponsored by the departed ones go as well
+	return s.UpdatePeers()
+}
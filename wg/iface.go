@@ -1,56 +1,54 @@
 package wg
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"net/netip"
-	"os"
 
+	"github.com/derlaft/w2wesher/config"
 	"github.com/derlaft/w2wesher/networkstate"
-	"github.com/vishvananda/netlink"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// DefaultMTU leaves room for the wireguard overhead in the common 1500 bytes MTU.
+const DefaultMTU = config.DefaultWgMTU
+
 // InterfaceUp creates the interface and routes to the overlay network
 func (s *State) InterfaceUp() error {
 
 	log.Debug("InterfaceUp")
 
-	if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: s.iface}}); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("creating link %s: %w", s.iface, err)
-	}
-
-	link, err := netlink.LinkByName(s.iface)
-	if err != nil {
-		return fmt.Errorf("getting link information for %s: %w", s.iface, err)
-	}
-
-	if err := netlink.AddrReplace(link, &netlink.Addr{
-		IPNet: addrToIPNet(s.overlayAddr),
-	}); err != nil {
-		return fmt.Errorf("setting address for %s: %w", s.iface, err)
-	}
+	addr, addr4 := s.overlayAddrs()
 
-	// TODO: make MTU configurable?
-	if err := netlink.LinkSetMTU(link, 1420); err != nil {
-		return fmt.Errorf("setting MTU for %s: %w", s.iface, err)
+	addrs := []netip.Addr{addr}
+	prefixes := []netip.Prefix{s.overlayPrefix}
+	if addr4.IsValid() {
+		addrs = append(addrs, addr4)
+		prefixes = append(prefixes, s.overlayPrefix4)
 	}
 
-	if err := netlink.LinkSetUp(link); err != nil {
-		return fmt.Errorf("enabling interface %s: %w", s.iface, err)
+	err := s.backend.LinkUp(Link{
+		Name:  s.iface,
+		Addrs: addrs,
+		MTU:   s.MTU(),
+	})
+	if err != nil {
+		return err
 	}
 
-	// add only one route per connection
-	if err := netlink.RouteAdd(&netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst:       prefixToIPNet(s.overlayPrefix),
-		Scope:     netlink.SCOPE_LINK,
-	}); err != nil && !errors.Is(err, os.ErrExist) {
-		return fmt.Errorf("adding route: %w", err)
+	// add only one route per connection and network
+	for _, prefix := range prefixes {
+		err = s.backend.RouteAdd(Route{
+			Link: s.iface,
+			Dst:  prefix,
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return s.masquerade()
 }
 
 // UpdatePeers updates the peers configuration
@@ -58,18 +56,42 @@ func (s *State) UpdatePeers() error {
 
 	log.Debug("UpdatePeers")
 
+	excluded, err := s.resolveConflicts()
+	if err != nil {
+		return err
+	}
+
 	nodes := s.state.Snapshot()
+	routes := s.acceptedRoutes(nodes)
+	exit, exitRoutes := s.exitRoutes(nodes)
 
-	peerCfgs, err := s.peerConfigs(nodes)
-	if err != nil {
-		return fmt.Errorf("converting received node information to wireguard format: %w", err)
+	allowed := make(map[peer.ID][]netip.Prefix)
+	for id, r := range routes {
+		allowed[id] = append(allowed[id], r...)
 	}
+	allowed[exit] = append(allowed[exit], exitRoutes...)
+
+	peerCfgs, members := s.peerConfigs(nodes, excluded, allowed)
 
-	err = s.client.ConfigureDevice(s.iface, wgtypes.Config{
-		PrivateKey: &s.privKey,
-		ListenPort: &s.listenPort,
+	staticCfgs, installed := s.staticPeerConfigs(nodes, peerCfgs)
+	peerCfgs = append(peerCfgs, staticCfgs...)
+
+	s.keyLock.RLock()
+	privKey := s.privKey
+	s.keyLock.RUnlock()
+
+	// the packets of wireguard itself bypass the exit node
+	var mark int
+	if len(exitRoutes) > 0 {
+		mark = ExitMark
+	}
+
+	err = s.backend.ConfigureDevice(s.iface, wgtypes.Config{
+		PrivateKey:   &privKey,
+		ListenPort:   &s.listenPort,
+		FirewallMark: &mark,
 		// even if libp2p connection is broken, we want to keep the old peers
-		// to have the best connectivity chances
+		// to have the best connectivity chances, the departed ones are removed by removeDeparted
 		ReplacePeers: false,
 		Peers:        peerCfgs,
 	})
@@ -77,32 +99,61 @@ func (s *State) UpdatePeers() error {
 		return fmt.Errorf("setting wireguard configuration for %s: %w", s.iface, err)
 	}
 
-	return nil
+	s.installedStatic = installed
+	s.installedMembers = members
+
+	err = s.syncRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	return s.syncExitPolicy(nodes, exit, exitRoutes)
 }
 
 // InterfaceDown shuts down the associated network interface.
 func (s *State) InterfaceDown() error {
-	_, err := s.client.Device(s.iface)
+	err := s.backend.SetExitPolicy(ExitPolicy{Link: s.iface, Table: ExitTable})
 	if err != nil {
-		if os.IsNotExist(err) {
-			// device already gone; noop
-			return nil
-		}
-
-		return fmt.Errorf("getting device %s: %w", s.iface, err)
+		return fmt.Errorf("removing exit node policy: %w", err)
 	}
 
-	link, err := netlink.LinkByName(s.iface)
+	err = s.backend.SetMasquerade(Masquerade{Link: s.iface})
 	if err != nil {
-		return fmt.Errorf("getting link for %s: %w", s.iface, err)
+		return fmt.Errorf("removing exit node masquerade: %w", err)
 	}
 
-	return netlink.LinkDel(link)
+	return s.backend.LinkDown(s.iface)
 }
 
-func (s *State) peerConfigs(nodes []networkstate.Info) ([]wgtypes.PeerConfig, error) {
-	peerCfgs := make([]wgtypes.PeerConfig, 0, len(nodes))
+// peerConfigs returns the configs of the mesh members
+// and the keys of the members installed on the device.
+// The accepted routes and the default routes of the exit node
+// are allowed in addition to the overlay addresses.
+// The members with an invalid announce are skipped, the error is logged once.
+func (s *State) peerConfigs(nodes []networkstate.Info, excluded map[peer.ID]map[string]bool, allowed map[peer.ID][]netip.Prefix) ([]wgtypes.PeerConfig, map[peer.ID][]wgtypes.Key) {
+	var (
+		peerCfgs  = make([]wgtypes.PeerConfig, 0, len(nodes))
+		installed = make(map[peer.ID][]wgtypes.Key)
+		refused   = make(map[string]bool)
+		owners    = s.keyOwners(nodes)
+	)
+
+	// refuse reports the invalid part of the announce once
+	refuse := func(id peer.ID, msg string, err error) {
+		key := fmt.Sprint(id, msg, err)
+		refused[key] = true
+		if !s.refusedPeers[key] {
+			log.
+				With("peer", id).
+				With("err", err).
+				Warn(msg)
+		}
+	}
+	defer func() {
+		s.refusedPeers = refused
+	}()
 
+nodes:
 	for _, node := range nodes {
 
 		as := node.LastAnnounce.WireguardState
@@ -114,27 +165,99 @@ func (s *State) peerConfigs(nodes []networkstate.Info) ([]wgtypes.PeerConfig, er
 
 		pubKey, err := wgtypes.ParseKey(as.PublicKey)
 		if err != nil {
-			return nil, fmt.Errorf("parsing wireguard key: %w", err)
+			refuse(node.ID, "invalid announced wireguard key, peer skipped", err)
+			continue
+		}
+
+		var allowedIPs []net.IPNet
+		for _, selected := range []struct {
+			raw     string
+			network netip.Prefix
+		}{
+			{as.SelectedAddr, s.overlayPrefix},
+			{as.SelectedAddr4, s.overlayPrefix4},
+		} {
+			if selected.raw == "" || s.expired(node) {
+				// not set or free to be claimed again
+				continue
+			}
+
+			selectedAddr, err := netip.ParseAddr(selected.raw)
+			if err != nil {
+				refuse(node.ID, "invalid announced overlay address, peer skipped", err)
+				continue nodes
+			}
+
+			selectedAddr = selectedAddr.Unmap()
+			if excluded[node.ID][selectedAddr.String()] {
+				// claimed by the winner of the conflict
+				continue
+			}
+
+			if !selected.network.Contains(selectedAddr) {
+				// would steal the traffic of the other networks
+				refuse(node.ID, "announced address is outside of the overlay network, dropped",
+					fmt.Errorf("%s is not in %s", selectedAddr, selected.network))
+				continue
+			}
+
+			allowedIPs = append(allowedIPs, *addrToIPNet(selectedAddr))
+		}
+
+		for _, route := range allowed[node.ID] {
+			allowedIPs = append(allowedIPs, *prefixToIPNet(route))
+		}
+
+		endpoint := &net.UDPAddr{
+			IP:   net.ParseIP(node.Addr),
+			Port: s.listenPort,
+		}
+
+		keys, pending, err := s.rotatedKeys(node.ID, pubKey, as, owners)
+		if err != nil {
+			refuse(node.ID, "invalid announced wireguard key rotation, peer skipped", err)
+			continue
 		}
 
-		selectedAddr, err := netip.ParseAddr(as.SelectedAddr)
+		psk, err := s.presharedKey(as, keys[0])
 		if err != nil {
-			return nil, fmt.Errorf("parsing selected addr: %w", err)
+			refuse(node.ID, "could not derive the preshared key, peer skipped", err)
+			continue
+		}
+
+		var nextPSK *wgtypes.Key
+		if pending {
+			nextPSK, err = s.presharedKey(as, keys[1])
+			if err != nil {
+				refuse(node.ID, "could not derive the preshared key, peer skipped", err)
+				continue
+			}
 		}
 
 		peerCfgs = append(peerCfgs, wgtypes.PeerConfig{
-			PublicKey:                   pubKey,
+			PublicKey:                   keys[0],
+			PresharedKey:                psk,
 			ReplaceAllowedIPs:           true,
 			PersistentKeepaliveInterval: s.persistentKeepalive,
-			Endpoint: &net.UDPAddr{
-				IP:   net.ParseIP(node.Addr),
-				Port: s.listenPort,
-			},
-			AllowedIPs: []net.IPNet{
-				*addrToIPNet(selectedAddr),
-			},
+			Endpoint:                    endpoint,
+			AllowedIPs:                  allowedIPs,
 		})
+
+		if pending {
+			// the next key is ready for the handshakes but gets no traffic yet
+			peerCfgs = append(peerCfgs, wgtypes.PeerConfig{
+				PublicKey:                   keys[1],
+				PresharedKey:                nextPSK,
+				ReplaceAllowedIPs:           true,
+				PersistentKeepaliveInterval: s.persistentKeepalive,
+				Endpoint:                    endpoint,
+			})
+		}
+
+		installed[node.ID] = keys
 	}
 
-	return peerCfgs, nil
+	peerCfgs = append(peerCfgs, s.retiredKeys(installed)...)
+
+	return peerCfgs, installed
 }
@@ -0,0 +1,250 @@
+package wg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/derlaft/w2wesher/networkstate"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/exp/slices"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keyOverlapAnnounces is the number of announce intervals the next key
+// is announced before the switch, so the others have a chance to learn it.
+const keyOverlapAnnounces = 3
+
+// maxKeyActivation limits how far ahead the next key of the others can be
+// activated: the scheduled updates are kept until then.
+const maxKeyActivation = 24 * time.Hour
+
+// resumeKeyRotation continues the rotation interrupted by a restart.
+func (s *State) resumeKeyRotation() error {
+	next, activation := s.cfg.State().NextWireguardKey()
+	if next == "" {
+		return nil
+	}
+
+	key, err := wgtypes.ParseKey(next)
+	if err != nil {
+		return fmt.Errorf("loading next private key: %w", err)
+	}
+
+	s.nextPrivKey = &key
+	s.keyActivation = activation
+	return nil
+}
+
+// RotateKey generates a new wireguard key and schedules the switch to it.
+// The public key and the activation time are returned.
+func (s *State) RotateKey() (wgtypes.Key, time.Time, error) {
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+
+	if s.nextPrivKey != nil {
+		return wgtypes.Key{}, time.Time{}, fmt.Errorf("key rotation is already scheduled at %v", s.keyActivation)
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return wgtypes.Key{}, time.Time{}, err
+	}
+
+	overlap := keyOverlapAnnounces * s.cfg.P2P.AnnounceInterval
+	activation := time.Now().Add(overlap).Truncate(time.Second)
+
+	err = s.cfg.State().SetNextWireguardKey(key.String(), activation)
+	if err != nil {
+		return wgtypes.Key{}, time.Time{}, fmt.Errorf("saving next private key: %w", err)
+	}
+
+	s.nextPrivKey = &key
+	s.keyActivation = activation
+
+	log.
+		With("key", key.PublicKey()).
+		With("activation", activation).
+		Warn("wireguard key rotation scheduled")
+
+	select {
+	case s.keyChanged <- struct{}{}:
+	default:
+		// already notified
+	}
+
+	// let the others learn the next key right away
+	s.notifyChanged()
+
+	return key.PublicKey(), activation, nil
+}
+
+// autoRotateKey starts the rotation once KeyRotationInterval has passed.
+func (s *State) autoRotateKey() {
+	s.keyLock.RLock()
+	var (
+		interval = s.keyRotationInterval
+		pending  = s.nextPrivKey != nil
+		last     = s.cfg.State().LastWireguardKeyRotation()
+	)
+	s.keyLock.RUnlock()
+
+	if interval <= 0 || pending || time.Since(last) < interval {
+		return
+	}
+
+	_, _, err := s.RotateKey()
+	if err != nil {
+		log.
+			With("err", err).
+			Error("could not start automatic key rotation")
+	}
+}
+
+func (s *State) resetKeyTimer(t *time.Timer) {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	t.Stop()
+	if s.nextPrivKey != nil {
+		t.Reset(time.Until(s.keyActivation))
+	}
+}
+
+// switchKey replaces the private key of the device with the next one.
+func (s *State) switchKey() error {
+	s.keyLock.Lock()
+	if s.nextPrivKey == nil {
+		s.keyLock.Unlock()
+		return nil
+	}
+	s.privKey = *s.nextPrivKey
+	s.pubKey = s.privKey.PublicKey()
+	s.nextPrivKey = nil
+	cfg := s.cfg
+	s.keyLock.Unlock()
+
+	log.With("key", s.pubKey).Warn("activating the new wireguard key")
+
+	err := cfg.CompleteWireguardKeyRotation()
+	if err != nil {
+		log.
+			With("err", err).
+			Error("could not save the rotated wireguard key")
+	}
+
+	return s.UpdatePeers()
+}
+
+// rotatedKeys returns the keys of the peer to install: the one used for
+// the traffic goes first, followed by the pending one if any.
+// The next key must not be used by anyone else: owners maps the keys
+// of the members and the static peers to their names.
+func (s *State) rotatedKeys(id peer.ID, current wgtypes.Key, as networkstate.WireguardState, owners map[wgtypes.Key]string) ([]wgtypes.Key, bool, error) {
+	if as.NextPublicKey == "" {
+		return []wgtypes.Key{current}, false, nil
+	}
+
+	next, err := wgtypes.ParseKey(as.NextPublicKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("parsing next wireguard key: %w", err)
+	}
+
+	if owner, ok := owners[next]; ok && owner != id.String() {
+		return nil, false, fmt.Errorf("next wireguard key %s is used by %s", next, owner)
+	}
+
+	activation := time.Unix(as.NextKeyActivation, 0)
+	if time.Until(activation) > maxKeyActivation {
+		return nil, false, fmt.Errorf("next wireguard key activation %v is more than %v ahead", activation, maxKeyActivation)
+	}
+
+	if time.Until(activation) <= 0 {
+		// the peer has switched already, even if it did not announce it yet
+		return []wgtypes.Key{next}, false, nil
+	}
+
+	s.scheduleUpdate(activation)
+	return []wgtypes.Key{current, next}, true, nil
+}
+
+// keyOwners maps the keys of this node, the members and the static peers to their names.
+func (s *State) keyOwners(nodes []networkstate.Info) map[wgtypes.Key]string {
+	s.keyLock.RLock()
+	owners := map[wgtypes.Key]string{s.pubKey: s.selfID.String()}
+	if s.nextPrivKey != nil {
+		owners[s.nextPrivKey.PublicKey()] = s.selfID.String()
+	}
+	s.keyLock.RUnlock()
+
+	for _, node := range nodes {
+		key, err := wgtypes.ParseKey(node.LastAnnounce.WireguardState.PublicKey)
+		if err == nil {
+			if _, ok := owners[key]; !ok {
+				owners[key] = node.ID.String()
+			}
+		}
+	}
+
+	for _, sp := range s.sponsoredPeers(nodes) {
+		key, err := wgtypes.ParseKey(sp.peer.PublicKey)
+		if err == nil {
+			if _, ok := owners[key]; !ok {
+				owners[key] = "static peer " + sp.peer.Name
+			}
+		}
+	}
+
+	return owners
+}
+
+// scheduleUpdate makes sure the peers are updated at the given time.
+func (s *State) scheduleUpdate(at time.Time) {
+	s.wakeupsLock.Lock()
+	defer s.wakeupsLock.Unlock()
+
+	ts := at.Unix()
+	if s.wakeups[ts] {
+		return
+	}
+	s.wakeups[ts] = true
+
+	time.AfterFunc(time.Until(at), func() {
+		s.wakeupsLock.Lock()
+		delete(s.wakeups, ts)
+		s.wakeupsLock.Unlock()
+
+		s.Update()
+	})
+}
+
+// retiredKeys removes the keys the members do not use anymore.
+func (s *State) retiredKeys(installed map[peer.ID][]wgtypes.Key) []wgtypes.PeerConfig {
+	var peerCfgs []wgtypes.PeerConfig
+
+	for id, old := range s.installedMembers {
+		current, ok := installed[id]
+		if !ok {
+			// not in the snapshot: keep it as it is
+			installed[id] = old
+			continue
+		}
+
+		for _, key := range old {
+			if slices.Contains(current, key) {
+				continue
+			}
+
+			log.
+				With("peer", id).
+				With("key", key).
+				Info("removing the rotated wireguard key")
+
+			peerCfgs = append(peerCfgs, wgtypes.PeerConfig{
+				PublicKey: key,
+				Remove:    true,
+			})
+		}
+	}
+
+	return peerCfgs
+}
@@ -0,0 +1,139 @@
+package wg
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/networkstate"
+)
+
+// proposalAnnounces is the number of announce intervals a proposed address
+// waits for the conflicting claims before it is leased.
+const proposalAnnounces = 2
+
+// chooseAddrs sets the initial overlay addresses: the pinned ones,
+// the ones leased before or the new proposal.
+func (s *State) chooseAddrs(cfg *config.Config) error {
+	c := cfg.Wireguard
+
+	if c.Address != "" {
+		addr, err := netip.ParseAddr(c.Address)
+		if err != nil {
+			return fmt.Errorf("parsing pinned address: %w", err)
+		}
+
+		var addr4 netip.Addr
+		if c.Address4 != "" {
+			addr4, err = netip.ParseAddr(c.Address4)
+			if err != nil {
+				return fmt.Errorf("parsing pinned IPv4 address: %w", err)
+			}
+		}
+
+		log.With("addr", addr).Info("using the pinned overlay address")
+		s.setOverlayAddrs(addr, addr4, networkstate.ClaimPinned)
+		return nil
+	}
+
+	addr, addr4, ok := s.validLease(cfg.State())
+	if ok {
+		log.With("addr", addr).Info("renewing the overlay address lease")
+		s.setOverlayAddrs(addr, addr4, networkstate.ClaimLeased)
+		return nil
+	}
+
+	return s.assignOverlayAddr()
+}
+
+// validLease returns the addresses leased before if the lease has not expired
+// and they still belong to the configured networks.
+func (s *State) validLease(state *config.State) (netip.Addr, netip.Addr, bool) {
+	rawAddr, rawAddr4, renewed := state.Lease()
+	if rawAddr == "" || time.Since(renewed) > s.leaseExpiry {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+
+	addr, err := netip.ParseAddr(rawAddr)
+	if err != nil || !s.overlayPrefix.Contains(addr) {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+
+	if !s.overlayPrefix4.IsValid() {
+		return addr, netip.Addr{}, true
+	}
+
+	addr4, err := netip.ParseAddr(rawAddr4)
+	if err != nil || !s.overlayPrefix4.Contains(addr4) {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+
+	return addr, addr4, true
+}
+
+// claimed returns the current claim of the overlay addresses.
+func (s *State) claimed() string {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	return s.claim
+}
+
+// maintainLease leases the proposed addresses once nobody has objected,
+// and renews the lease in the state file.
+func (s *State) maintainLease() error {
+	addr, addr4 := s.overlayAddrs()
+
+	switch s.claimed() {
+	case networkstate.ClaimProposed:
+		wait := proposalAnnounces * s.cfg.P2P.AnnounceInterval
+		if time.Since(s.proposedAt) < wait {
+			return nil
+		}
+
+		for _, c := range s.state.Conflicts(s.selfID, s.AnnounceInfo(), s.leaseExpiry) {
+			if c.Lost(s.selfID) {
+				// moved to other addresses by the next update
+				return nil
+			}
+		}
+
+		err := s.saveLease(addr, addr4)
+		if err != nil {
+			return err
+		}
+
+		log.With("addr", addr).Info("overlay address leased")
+		s.setOverlayAddrs(addr, addr4, networkstate.ClaimLeased)
+		s.notifyChanged()
+
+	case networkstate.ClaimLeased:
+		_, _, renewed := s.cfg.State().Lease()
+		if time.Since(renewed) > s.leaseExpiry/4 {
+			return s.saveLease(addr, addr4)
+		}
+	}
+
+	return nil
+}
+
+func (s *State) saveLease(addr, addr4 netip.Addr) error {
+	var raw4 string
+	if addr4.IsValid() {
+		raw4 = addr4.String()
+	}
+
+	err := s.cfg.State().SetLease(addr.String(), raw4, time.Now())
+	if err != nil {
+		return fmt.Errorf("saving lease: %w", err)
+	}
+
+	return nil
+}
+
+// expired returns true if the lease of the peer has expired:
+// its addresses are free to be claimed by the others.
+func (s *State) expired(info networkstate.Info) bool {
+	return s.leaseExpiry > 0 && time.Since(info.LastSeen) > s.leaseExpiry
+}
@@ -0,0 +1,147 @@
+package wg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// forwardingSysctls enable the forwarding of the IP versions.
+var forwardingSysctls = map[int]string{
+	4: "/proc/sys/net/ipv4/ip_forward",
+	6: "/proc/sys/net/ipv6/conf/all/forwarding",
+}
+
+// iptablesRule is a rule managed with iptables or ip6tables.
+type iptablesRule struct {
+	version int
+	table   string
+	chain   string
+	args    []string
+}
+
+func (r iptablesRule) command() string {
+	if r.version == 6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (r iptablesRule) String() string {
+	return fmt.Sprintf("%s -t %s %s %s", r.command(), r.table, r.chain, strings.Join(r.args, " "))
+}
+
+// run executes the rule with the action: -A, -D or -C.
+func (r iptablesRule) run(action string) error {
+	args := append([]string{"-w", "-t", r.table, action, r.chain}, r.args...)
+
+	out, err := exec.Command(r.command(), args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", r.command(), strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+func (r iptablesRule) exists() bool {
+	return r.run("-C") == nil
+}
+
+// masqueradeRules returns the iptables rules of the exit node by their description.
+func masqueradeRules(m Masquerade) map[string]iptablesRule {
+	rules := make(map[string]iptablesRule)
+	add := func(r iptablesRule) {
+		rules[r.String()] = r
+	}
+
+	for _, src := range m.Sources {
+		version := 6
+		if src.Addr().Is4() {
+			version = 4
+		}
+
+		add(iptablesRule{version, "nat", "POSTROUTING", []string{"-s", src.String(), "!", "-o", m.Link, "-j", "MASQUERADE"}})
+		// the FORWARD chain might drop everything by default
+		add(iptablesRule{version, "filter", "FORWARD", []string{"-i", m.Link, "-j", "ACCEPT"}})
+		add(iptablesRule{version, "filter", "FORWARD", []string{"-o", m.Link, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}})
+	}
+
+	return rules
+}
+
+// forwardingVersions returns the IP versions forwarded by the masquerade.
+func forwardingVersions(m Masquerade) []int {
+	var v4, v6 bool
+	for _, src := range m.Sources {
+		v4 = v4 || src.Addr().Is4()
+		v6 = v6 || !src.Addr().Is4()
+	}
+
+	var versions []int
+	if v4 {
+		versions = append(versions, 4)
+	}
+	if v6 {
+		versions = append(versions, 6)
+	}
+	return versions
+}
+
+func forwardingEnabled(version int) (bool, error) {
+	value, err := ioutil.ReadFile(forwardingSysctls[version])
+	if err != nil {
+		return false, err
+	}
+
+	return string(bytes.TrimSpace(value)) == "1", nil
+}
+
+func (b *netlinkBackend) SetMasquerade(m Masquerade) error {
+	// the forwarding is left enabled, other software might rely on it
+	for _, version := range forwardingVersions(m) {
+		enabled, err := forwardingEnabled(version)
+		if err != nil {
+			return fmt.Errorf("reading IPv%d forwarding: %w", version, err)
+		}
+
+		if enabled {
+			continue
+		}
+
+		log.With("sysctl", forwardingSysctls[version]).Info("enabling forwarding")
+		err = ioutil.WriteFile(forwardingSysctls[version], []byte("1"), 0644)
+		if err != nil {
+			return fmt.Errorf("enabling IPv%d forwarding: %w", version, err)
+		}
+	}
+
+	wanted := masqueradeRules(m)
+
+	for key, r := range wanted {
+		if !r.exists() {
+			err := r.run("-A")
+			if err != nil {
+				return err
+			}
+		}
+		b.masquerade[key] = r
+	}
+
+	for key, r := range b.masquerade {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+
+		if r.exists() {
+			err := r.run("-D")
+			if err != nil {
+				return err
+			}
+		}
+		delete(b.masquerade, key)
+	}
+
+	return nil
+}
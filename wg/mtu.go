@@ -0,0 +1,438 @@
+package wg
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/derlaft/w2wesher/config"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// mtuInterval is how often the auto MTU is re-evaluated.
+	mtuInterval = 5 * time.Minute
+	// mtuFirstDelay gives the peers a chance to be discovered before the first evaluation.
+	mtuFirstDelay = 30 * time.Second
+	// mtuCeilingTTL is how long a failed probe size is not tried again.
+	mtuCeilingTTL = time.Hour
+	// MTUProbePort is the udp port on the overlay addr answering the MTU probes.
+	MTUProbePort = 10044
+	// mtuProbeTimeout is the time to wait for a single probe reply.
+	mtuProbeTimeout = time.Second
+	// mtuProbeAttempts is the number of probes sent before giving up on a size.
+	mtuProbeAttempts = 2
+	// mtuProbeStep is the precision of the probing.
+	mtuProbeStep = 8
+	// wireguard overhead over the ipv4 and ipv6 underlay
+	overheadIPv4 = 60
+	overheadIPv6 = 80
+	// ip and udp header sizes of the probes
+	headerIPv4 = 20
+	headerIPv6 = 40
+	headerUDP  = 8
+)
+
+// mtuProbeMagic starts the probes and the replies.
+var mtuProbeMagic = []byte("w2mp")
+
+// applyMTU applies the MTU setting, the auto MTU starts from the current value.
+func (s *State) applyMTU(c config.Wireguard) {
+	mtu, auto, err := c.ParseMTU()
+	if err != nil {
+		// already validated
+		mtu, auto = DefaultMTU, false
+	}
+
+	s.mtuAuto.Store(auto)
+	if !auto {
+		s.mtu.Store(int32(mtu))
+		return
+	}
+
+	if s.mtu.Load() == 0 {
+		s.mtu.Store(DefaultMTU)
+	}
+
+	select {
+	case s.mtuEvaluate <- struct{}{}:
+	default:
+		// already pending
+	}
+}
+
+// MTU returns the MTU of the interface.
+func (s *State) MTU() int {
+	return int(s.mtu.Load())
+}
+
+// mtuChange is applied by the Run loop, done is closed once the interface is updated.
+type mtuChange struct {
+	mtu  int
+	done chan struct{}
+}
+
+// setMTU makes the Run loop apply the interface MTU and waits for it.
+func (s *State) setMTU(ctx context.Context, mtu int) bool {
+	c := mtuChange{mtu, make(chan struct{})}
+
+	select {
+	case s.mtuChanged <- c:
+	case <-ctx.Done():
+		return false
+	}
+
+	select {
+	case <-c.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// discoverMTU periodically evaluates the auto MTU and sends the changes to the Run loop.
+func (s *State) discoverMTU(ctx context.Context) {
+	t := time.NewTicker(mtuInterval)
+	defer t.Stop()
+
+	first := time.NewTimer(mtuFirstDelay)
+	defer first.Stop()
+
+	var (
+		// ceiling is the largest size which passed the probes after a failed one,
+		// larger sizes are not tried until mtuCeilingTTL
+		ceiling     int
+		ceilingTime time.Time
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-first.C:
+		case <-s.mtuEvaluate:
+		}
+
+		if !s.mtuAuto.Load() {
+			continue
+		}
+
+		if time.Since(ceilingTime) > mtuCeilingTTL {
+			ceiling = 0
+		}
+
+		current := s.MTU()
+		mtu, limited := s.evaluateMTU(ctx, current, ceiling)
+		if !s.mtuAuto.Load() {
+			// switched off during the probes
+			continue
+		}
+		if limited > 0 {
+			ceiling, ceilingTime = limited, time.Now()
+		}
+
+		if mtu != current {
+			log.
+				With("old", current).
+				With("new", mtu).
+				Info("changing the interface MTU")
+		}
+
+		// the interface might have the MTU raised for the probes
+		if mtu != s.MTU() && !s.setMTU(ctx, mtu) {
+			return
+		}
+	}
+}
+
+// evaluateMTU returns the MTU fitting the underlay routes and the probes to the peers.
+// The larger MTU is only returned if the probes of that size have passed, see raiseMTU.
+// If a probe has failed, the size which passed is returned as the new ceiling, or 0.
+func (s *State) evaluateMTU(ctx context.Context, current, ceiling int) (int, int) {
+	var (
+		upper = 0
+		peers []netip.Addr
+	)
+
+	for _, node := range s.state.Snapshot() {
+		ws := node.LastAnnounce.WireguardState
+		if !ws.IsValid() {
+			continue
+		}
+
+		if overlay, err := netip.ParseAddr(ws.SelectedAddr); err == nil {
+			peers = append(peers, overlay)
+		}
+
+		underlay, err := netip.ParseAddr(node.Addr)
+		if err != nil {
+			continue
+		}
+
+		mtu, err := s.backend.PathMTU(underlay)
+		if err != nil {
+			log.
+				With("peer", node.ID).
+				With("err", err).
+				Debug("could not get the underlay MTU")
+			continue
+		}
+
+		mtu -= overhead(underlay)
+		if upper == 0 || mtu < upper {
+			upper = mtu
+		}
+	}
+
+	if upper == 0 {
+		// nothing is known about the peers yet
+		return current, 0
+	}
+
+	if ceiling > 0 && ceiling < upper {
+		upper = ceiling
+	}
+
+	mtu := clampMTU(upper)
+	if mtu > current {
+		return s.raiseMTU(ctx, peers, current, mtu)
+	}
+
+	limited := 0
+	for _, peer := range peers {
+		working, ok := s.probePeer(ctx, peer, mtu)
+		if !ok {
+			// the peer does not answer the probes at all
+			continue
+		}
+
+		if working < mtu {
+			mtu, limited = working, working
+		}
+	}
+
+	return mtu, limited
+}
+
+// raiseMTU probes the larger MTU: the probes can not be larger than the interface MTU,
+// so it is raised for the time of the probes. Only the full size is probed,
+// so the larger packets are not lost for long if it does not fit.
+// The larger MTU is kept if one of the peers has answered and nobody has failed.
+// The probing stops once the auto MTU is switched off.
+func (s *State) raiseMTU(ctx context.Context, peers []netip.Addr, current, mtu int) (int, int) {
+	if !s.setMTU(ctx, mtu) || !s.mtuAuto.Load() {
+		return current, 0
+	}
+
+	confirmed := false
+	for _, peer := range peers {
+		if !s.mtuAuto.Load() {
+			return current, 0
+		}
+
+		if s.probe(ctx, peer, mtu) {
+			confirmed = true
+			continue
+		}
+
+		if s.probe(ctx, peer, config.MinWgMTU) {
+			// the peer answers, but the larger size does not fit:
+			// the current MTU is kept until the ceiling expires
+			log.
+				With("peer", peer).
+				With("mtu", mtu).
+				Debug("larger MTU does not fit the path to the peer")
+			return current, current
+		}
+	}
+
+	if !confirmed {
+		// nobody answers the probes
+		return current, 0
+	}
+
+	return mtu, 0
+}
+
+// probePeer finds the largest working size up to max.
+// False is returned if even the smallest probe gets no reply.
+func (s *State) probePeer(ctx context.Context, peer netip.Addr, max int) (int, bool) {
+	if !s.probe(ctx, peer, config.MinWgMTU) {
+		return 0, false
+	}
+
+	if s.probe(ctx, peer, max) {
+		return max, true
+	}
+
+	lo, hi := config.MinWgMTU, max
+	for hi-lo > mtuProbeStep {
+		mid := (lo + hi) / 2
+		if s.probe(ctx, peer, mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	log.
+		With("peer", peer).
+		With("mtu", lo).
+		Info("path MTU to the peer is smaller than the interface MTU")
+
+	return lo, true
+}
+
+// probe sends an udp packet of the given ip size with the DF bit to the peer.
+func (s *State) probe(ctx context.Context, peer netip.Addr, size int) bool {
+	header := headerIPv4
+	if peer.Is6() {
+		header = headerIPv6
+	}
+
+	payload := make([]byte, size-header-headerUDP)
+	copy(payload, mtuProbeMagic)
+
+	local, _ := s.overlayAddrs()
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(local, 0)))
+	if err != nil {
+		log.With("err", err).Debug("could not open the MTU probe socket")
+		return false
+	}
+	defer conn.Close()
+
+	err = setDontFragment(conn, peer.Is6())
+	if err != nil {
+		log.With("err", err).Debug("could not set the DF bit")
+		return false
+	}
+
+	dst := net.UDPAddrFromAddrPort(netip.AddrPortFrom(peer, MTUProbePort))
+	reply := make([]byte, 64)
+
+	for i := 0; i < mtuProbeAttempts && ctx.Err() == nil; i++ {
+		binary.BigEndian.PutUint32(payload[len(mtuProbeMagic):], uint32(i))
+
+		_, err = conn.WriteToUDP(payload, dst)
+		if errors.Is(err, syscall.EMSGSIZE) {
+			// larger than the interface or the known path MTU
+			return false
+		}
+		if err != nil {
+			return false
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(mtuProbeTimeout))
+		n, _, err := conn.ReadFromUDP(reply)
+		if err != nil {
+			continue
+		}
+
+		if n >= 8 && bytes.Equal(reply[:8], payload[:8]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// answerMTUProbes replies to the probes of the others with the first bytes of the probe,
+// so the reply fits any path. The socket follows the changes of the overlay address.
+func (s *State) answerMTUProbes(ctx context.Context) {
+	for {
+		addr, _ := s.overlayAddrs()
+
+		conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, MTUProbePort)))
+		if err != nil {
+			log.
+				With("err", err).
+				Warn("could not listen for the MTU probes")
+			return
+		}
+
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-s.readdressed:
+			case <-done:
+			}
+			conn.Close()
+		}()
+
+		err = serveMTUProbes(conn)
+		close(done)
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case !errors.Is(err, net.ErrClosed):
+			log.With("err", err).Error("reading MTU probe")
+			return
+		}
+		// readdressed: listen on the new address
+	}
+}
+
+func serveMTUProbes(conn *net.UDPConn) error {
+	buf := make([]byte, config.MaxWgMTU)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		if n < 8 || !bytes.Equal(buf[:len(mtuProbeMagic)], mtuProbeMagic) {
+			continue
+		}
+
+		_, _ = conn.WriteToUDP(buf[:8], addr)
+	}
+}
+
+// setDontFragment makes the kernel send the packets with the DF bit,
+// ignoring the cached path MTU.
+func setDontFragment(conn *net.UDPConn, ipv6 bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
+
+func overhead(underlay netip.Addr) int {
+	if underlay.Is4() || underlay.Is4In6() {
+		return overheadIPv4
+	}
+	return overheadIPv6
+}
+
+func clampMTU(mtu int) int {
+	if mtu < config.MinWgMTU {
+		return config.MinWgMTU
+	}
+	if mtu > config.MaxWgMTU {
+		return config.MaxWgMTU
+	}
+	return mtu
+}
@@ -0,0 +1,236 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// exitRulePriority is the priority of the first policy rule of the exit node,
+// the three rules in a row are owned by w2wesher:
+// the bypassed endpoints, the main table without the default route
+// and the exit table for everything not marked by wireguard.
+const exitRulePriority = 5300
+
+var families = []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+
+// familyRule is the policy rule with its address family,
+// which is not reported by netlink.
+type familyRule struct {
+	family int
+	rule   netlink.Rule
+}
+
+func (r familyRule) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "rule %s priority %d", familyName(r.family), r.rule.Priority)
+	if r.rule.Dst != nil {
+		fmt.Fprintf(&b, " to %s", r.rule.Dst)
+	}
+	if r.rule.Mark >= 0 {
+		if r.rule.Invert {
+			b.WriteString(" not")
+		}
+		fmt.Fprintf(&b, " fwmark %d", r.rule.Mark)
+	}
+	fmt.Fprintf(&b, " lookup %d", r.rule.Table)
+	if r.rule.SuppressPrefixlen >= 0 {
+		fmt.Fprintf(&b, " suppress_prefixlength %d", r.rule.SuppressPrefixlen)
+	}
+
+	return b.String()
+}
+
+func familyName(family int) string {
+	if family == netlink.FAMILY_V6 {
+		return "-6"
+	}
+	return "-4"
+}
+
+func addrFamily(addr netip.Addr) int {
+	if addr.Unmap().Is4() {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// exitRules returns the policy rules of the exit node by their description.
+func exitRules(p ExitPolicy) map[string]familyRule {
+	rules := make(map[string]familyRule)
+	add := func(family int, r *netlink.Rule) {
+		r.Family = family
+		fr := familyRule{family, *r}
+		rules[fr.String()] = fr
+	}
+
+	for _, dst := range p.Dsts {
+		family := addrFamily(dst.Addr())
+
+		for _, addr := range p.Bypass {
+			addr = addr.Unmap()
+			if addrFamily(addr) != family {
+				continue
+			}
+
+			r := netlink.NewRule()
+			r.Priority = exitRulePriority
+			r.Dst = addrToIPNet(addr)
+			r.Table = unix.RT_TABLE_MAIN
+			add(family, r)
+		}
+
+		// the routes of the main table are used, except the default one
+		r := netlink.NewRule()
+		r.Priority = exitRulePriority + 1
+		r.Table = unix.RT_TABLE_MAIN
+		r.SuppressPrefixlen = 0
+		add(family, r)
+
+		r = netlink.NewRule()
+		r.Priority = exitRulePriority + 2
+		r.Table = p.Table
+		r.Mark = p.Mark
+		r.Invert = true
+		add(family, r)
+	}
+
+	return rules
+}
+
+// installedExitRules returns the policy rules of the exit node found in the system.
+func installedExitRules() (map[string]familyRule, error) {
+	rules := make(map[string]familyRule)
+
+	for _, family := range families {
+		list, err := netlink.RuleList(family)
+		if err != nil {
+			return nil, fmt.Errorf("listing rules: %w", err)
+		}
+
+		for _, r := range list {
+			if r.Priority < exitRulePriority || r.Priority > exitRulePriority+2 {
+				continue
+			}
+
+			r.Family = family
+			fr := familyRule{family, r}
+			rules[fr.String()] = fr
+		}
+	}
+
+	return rules, nil
+}
+
+// installedExitRoutes returns the routes of the exit table found in the system.
+func installedExitRoutes(table int) ([]netlink.Route, error) {
+	var routes []netlink.Route
+
+	for _, family := range families {
+		list, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, fmt.Errorf("listing routes of table %d: %w", table, err)
+		}
+		routes = append(routes, list...)
+	}
+
+	return routes, nil
+}
+
+func formatExitRoute(p ExitPolicy, dst netip.Prefix) string {
+	return fmt.Sprintf("route %s dev %s table %d", dst, p.Link, p.Table)
+}
+
+func (b *netlinkBackend) SetExitPolicy(p ExitPolicy) error {
+	wanted := exitRules(p)
+
+	installed, err := installedExitRules()
+	if err != nil {
+		return err
+	}
+
+	// the routes go first, so the traffic is never sent to the empty table
+	err = b.syncExitRoutes(p)
+	if err != nil {
+		return err
+	}
+
+	for key, r := range wanted {
+		if _, ok := installed[key]; ok {
+			continue
+		}
+
+		if err := netlink.RuleAdd(&r.rule); err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("adding %s: %w", key, err)
+		}
+	}
+
+	for key, r := range installed {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+
+		if err := netlink.RuleDel(&r.rule); err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("removing %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// syncExitRoutes installs the default routes of the exit table
+// and removes the ones of the families not routed via the exit node.
+func (b *netlinkBackend) syncExitRoutes(p ExitPolicy) error {
+	routed := make(map[int]bool)
+
+	if len(p.Dsts) > 0 {
+		link, err := netlink.LinkByName(p.Link)
+		if err != nil {
+			return fmt.Errorf("getting link information for %s: %w", p.Link, err)
+		}
+
+		for _, dst := range p.Dsts {
+			routed[addrFamily(dst.Addr())] = true
+
+			if err := netlink.RouteReplace(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       prefixToIPNet(dst),
+				Table:     p.Table,
+				Scope:     netlink.SCOPE_LINK,
+			}); err != nil {
+				return fmt.Errorf("adding %s: %w", formatExitRoute(p, dst), err)
+			}
+		}
+	}
+
+	routes, err := installedExitRoutes(p.Table)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range routes {
+		if routed[r.Family] {
+			continue
+		}
+
+		if r.Dst == nil {
+			// netlink reports the default routes without the destination
+			r.Dst = prefixToIPNet(defaultRoute4)
+			if r.Family == netlink.FAMILY_V6 {
+				r.Dst = prefixToIPNet(defaultRoute6)
+			}
+		}
+
+		if err := netlink.RouteDel(&r); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("removing route of table %d: %w", p.Table, err)
+		}
+	}
+
+	return nil
+}
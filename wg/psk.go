@@ -0,0 +1,96 @@
+package wg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/derlaft/w2wesher/networkstate"
+	"golang.org/x/crypto/hkdf"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PresharedKeyVersion is announced by the nodes deriving the preshared keys,
+// the peers of the older versions are configured without one.
+const PresharedKeyVersion = 1
+
+// pskSalt separates the preshared keys from the other uses of the network PSK.
+const pskSalt = "w2wesher wireguard preshared key v1"
+
+// derivePresharedKey derives the preshared key of the pair of the wireguard keys
+// from the network PSK. Both peers get the same key without any exchange.
+func derivePresharedKey(networkPSK []byte, a, b wgtypes.Key, epoch int64) (wgtypes.Key, error) {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+
+	info := make([]byte, 2*wgtypes.KeyLen+8)
+	copy(info, a[:])
+	copy(info[wgtypes.KeyLen:], b[:])
+	binary.BigEndian.PutUint64(info[2*wgtypes.KeyLen:], uint64(epoch))
+
+	var key wgtypes.Key
+	_, err := io.ReadFull(hkdf.New(sha256.New, networkPSK, []byte(pskSalt), info), key[:])
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("deriving preshared key: %w", err)
+	}
+
+	return key, nil
+}
+
+// pskEpoch returns the derivation epoch for the rotation interval
+// and the start of the next one, zero if the keys are not rotated.
+func pskEpoch(interval time.Duration, now time.Time) (int64, time.Time) {
+	if interval <= 0 {
+		return 0, time.Time{}
+	}
+
+	epoch := now.UnixNano() / int64(interval)
+	return epoch, time.Unix(0, (epoch+1)*int64(interval))
+}
+
+// presharedKey returns the preshared key for the peer key announced in as.
+// The longer rotation interval of the pair is used, so both peers agree on the epoch.
+func (s *State) presharedKey(as networkstate.WireguardState, peerKey wgtypes.Key) (*wgtypes.Key, error) {
+	if as.PSKVersion < PresharedKeyVersion {
+		// the zero key removes the preshared key
+		return &wgtypes.Key{}, nil
+	}
+
+	s.keyLock.RLock()
+	var (
+		networkPSK = s.networkPSK
+		pubKey     = s.pubKey
+		interval   = s.pskRotation
+	)
+	s.keyLock.RUnlock()
+
+	if announced := time.Duration(as.PSKRotation) * time.Second; announced > interval {
+		interval = announced
+	}
+
+	epoch, next := pskEpoch(interval, time.Now())
+	if !next.IsZero() {
+		s.scheduleUpdate(next)
+	}
+
+	key, err := derivePresharedKey(networkPSK, pubKey, peerKey, epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// SetNetworkPSK replaces the network PSK the preshared keys are derived from
+// after the PSK rotation.
+func (s *State) SetNetworkPSK(psk []byte) {
+	s.keyLock.Lock()
+	s.networkPSK = psk
+	s.keyLock.Unlock()
+
+	s.Update()
+}
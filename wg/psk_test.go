@@ -0,0 +1,88 @@
+package wg
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testKeys() (wgtypes.Key, wgtypes.Key, []byte) {
+	var a, b wgtypes.Key
+	for i := range a {
+		a[i] = byte(i)
+		b[i] = byte(255 - i)
+	}
+
+	return a, b, bytes.Repeat([]byte{0x42}, 32)
+}
+
+func TestDerivePresharedKey(t *testing.T) {
+	a, b, psk := testKeys()
+
+	tests := []struct {
+		name   string
+		psk    []byte
+		a, b   wgtypes.Key
+		epoch  int64
+		want   string
+		equals bool
+	}{
+		// pinned, so both peers of the different versions keep agreeing on the key
+		{"pinned", psk, a, b, 0, "Od08uRjhnQc+wqR6tr+ip65GYJrvvuehuqvQe+kAr5Y=", true},
+		{"key order does not matter", psk, b, a, 0, "Od08uRjhnQc+wqR6tr+ip65GYJrvvuehuqvQe+kAr5Y=", true},
+		{"pinned next epoch", psk, b, a, 1, "IsOJOi//XYRRZ/FvJxWmG5drhboEvDlZxIxsmZGiK38=", true},
+		{"another network PSK", bytes.Repeat([]byte{0x43}, 32), a, b, 0, "Od08uRjhnQc+wqR6tr+ip65GYJrvvuehuqvQe+kAr5Y=", false},
+		{"another pair", psk, a, a, 0, "Od08uRjhnQc+wqR6tr+ip65GYJrvvuehuqvQe+kAr5Y=", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := derivePresharedKey(tt.psk, tt.a, tt.b, tt.epoch)
+			if err != nil {
+				t.Fatalf("derivePresharedKey() error = %v", err)
+			}
+
+			if (got.String() == tt.want) != tt.equals {
+				t.Errorf("derivePresharedKey() = %s, want equal to %s: %v", got, tt.want, tt.equals)
+			}
+
+			if got == (wgtypes.Key{}) {
+				t.Errorf("derivePresharedKey() returned the zero key, which disables the preshared key")
+			}
+		})
+	}
+}
+
+func TestPSKEpoch(t *testing.T) {
+	boundary := time.Unix(1700000000, 0).Truncate(time.Hour)
+
+	tests := []struct {
+		name      string
+		interval  time.Duration
+		now       time.Time
+		wantEpoch int64
+		wantNext  time.Time
+	}{
+		{"not rotated", 0, boundary, 0, time.Time{}},
+		{"negative interval", -time.Hour, boundary, 0, time.Time{}},
+		{"at the boundary", time.Hour, boundary, boundary.Unix() / 3600, boundary.Add(time.Hour)},
+		{"just before the boundary", time.Hour, boundary.Add(-time.Nanosecond), boundary.Unix()/3600 - 1, boundary},
+		{"inside the interval", time.Hour, boundary.Add(59 * time.Minute), boundary.Unix() / 3600, boundary.Add(time.Hour)},
+		{"longer interval", 24 * time.Hour, time.Unix(86400*3+5, 0), 3, time.Unix(86400*4, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			epoch, next := pskEpoch(tt.interval, tt.now)
+			if epoch != tt.wantEpoch {
+				t.Errorf("pskEpoch() epoch = %d, want %d", epoch, tt.wantEpoch)
+			}
+
+			if !next.Equal(tt.wantNext) {
+				t.Errorf("pskEpoch() next = %s, want %s", next, tt.wantNext)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package wg
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// maxOperations is the number of the recorded operations kept in memory.
+const maxOperations = 100
+
+// Operation is a change the recorder has not applied.
+type Operation struct {
+	Time time.Time
+	// Kind is one of link-up, route-add, route-del, configure-device, link-down,
+	// exit-policy, masquerade
+	Kind string
+	// Config lists the exact settings which would have been applied
+	Config []string
+	// Diff lists the differences from the current state of the system,
+	// prefixed with + (added), - (removed) or ~ (changed)
+	Diff []string
+}
+
+// Recorder is the backend which never changes anything:
+// it only reads the current state and records the operations.
+type Recorder struct {
+	// client is used for reading the current state only
+	client *wgctrl.Client
+	lock   sync.Mutex
+	ops    []Operation
+	// masquerade lists the iptables rules which would have been added
+	masquerade map[string]iptablesRule
+}
+
+// NewRecorder returns the backend for the dry-run mode.
+func NewRecorder() (*Recorder, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("instantiating wireguard client: %w", err)
+	}
+
+	return &Recorder{
+		client:     client,
+		masquerade: make(map[string]iptablesRule),
+	}, nil
+}
+
+// Operations returns the recorded operations, the oldest first.
+func (r *Recorder) Operations() []Operation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]Operation{}, r.ops...)
+}
+
+func (r *Recorder) record(kind string, config, diff []string) {
+	op := Operation{
+		Time:   time.Now(),
+		Kind:   kind,
+		Config: config,
+		Diff:   diff,
+	}
+
+	r.lock.Lock()
+	r.ops = append(r.ops, op)
+	if len(r.ops) > maxOperations {
+		r.ops = r.ops[len(r.ops)-maxOperations:]
+	}
+	r.lock.Unlock()
+
+	l := log.
+		With("op", kind).
+		With("config", strings.Join(config, "; ")).
+		With("diff", strings.Join(diff, "; "))
+
+	if len(diff) > 0 {
+		l.Info("dry-run: would apply")
+	} else {
+		l.Debug("dry-run: nothing to change")
+	}
+}
+
+func (r *Recorder) LinkUp(l Link) error {
+	config := []string{fmt.Sprintf("link %s type wireguard", l.Name)}
+	for _, addr := range l.Addrs {
+		config = append(config, fmt.Sprintf("addr %s", addrToIPNet(addr)))
+	}
+	config = append(config, fmt.Sprintf("mtu %d", l.MTU), "up")
+
+	var diff []string
+	link, err := netlink.LinkByName(l.Name)
+	switch {
+	case err != nil:
+		diff = append(diff, fmt.Sprintf("+ link %s type wireguard", l.Name))
+		for _, addr := range l.Addrs {
+			diff = append(diff, fmt.Sprintf("+ addr %s", addrToIPNet(addr)))
+		}
+		diff = append(diff,
+			fmt.Sprintf("~ mtu %d", l.MTU),
+			"~ up")
+	default:
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			diff = append(diff, fmt.Sprintf("? addrs unknown: %v", err))
+		}
+
+		for _, want := range l.Addrs {
+			found := false
+			for _, addr := range addrs {
+				found = found || addr.IPNet.String() == addrToIPNet(want).String()
+			}
+			if !found && err == nil {
+				diff = append(diff, fmt.Sprintf("+ addr %s", addrToIPNet(want)))
+			}
+		}
+
+		stale, err := staleAddrs(link, l.Addrs)
+		if err == nil {
+			for _, addr := range stale {
+				diff = append(diff, fmt.Sprintf("- addr %s", addr.IPNet))
+			}
+		}
+
+		if mtu := link.Attrs().MTU; mtu != l.MTU {
+			diff = append(diff, fmt.Sprintf("~ mtu %d -> %d", mtu, l.MTU))
+		}
+
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			diff = append(diff, "~ up")
+		}
+	}
+
+	r.record("link-up", config, diff)
+	return nil
+}
+
+func (r *Recorder) RouteAdd(route Route) error {
+	config := []string{
+		fmt.Sprintf("route %s dev %s scope link", route.Dst, route.Link),
+	}
+
+	var diff []string
+	if !r.hasRoute(route) {
+		diff = append(diff, "+ "+config[0])
+	}
+
+	r.record("route-add", config, diff)
+	return nil
+}
+
+func (r *Recorder) RouteDel(route Route) error {
+	config := []string{
+		fmt.Sprintf("route %s dev %s scope link", route.Dst, route.Link),
+	}
+
+	var diff []string
+	if r.hasRoute(route) {
+		diff = append(diff, "- "+config[0])
+	}
+
+	r.record("route-del", config, diff)
+	return nil
+}
+
+func (r *Recorder) hasRoute(route Route) bool {
+	link, err := netlink.LinkByName(route.Link)
+	if err != nil {
+		return false
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false
+	}
+
+	for _, existing := range routes {
+		if existing.Dst != nil && existing.Dst.String() == prefixToIPNet(route.Dst).String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Recorder) ConfigureDevice(iface string, cfg wgtypes.Config) error {
+	var config []string
+	if cfg.PrivateKey != nil {
+		config = append(config, "private-key <redacted>")
+	}
+	if cfg.ListenPort != nil {
+		config = append(config, fmt.Sprintf("listen-port %d", *cfg.ListenPort))
+	}
+	if cfg.ReplacePeers {
+		config = append(config, "replace-peers")
+	}
+	for _, p := range cfg.Peers {
+		config = append(config, formatPeerConfig(p))
+	}
+
+	device, err := r.client.Device(iface)
+	if err != nil && !os.IsNotExist(err) {
+		r.record("configure-device", config, []string{fmt.Sprintf("? current state unknown: %v", err)})
+		return nil
+	}
+	if err != nil {
+		// everything is new
+		device = &wgtypes.Device{Name: iface}
+	}
+
+	r.record("configure-device", config, diffDevice(device, cfg))
+	return nil
+}
+
+// PathMTU only reads the routing table, so it is not recorded.
+func (r *Recorder) PathMTU(dst netip.Addr) (int, error) {
+	return routeMTU(dst)
+}
+
+// ConnectedRoutes only reads the routing table as well.
+func (r *Recorder) ConnectedRoutes(exclude string) ([]netip.Prefix, error) {
+	return connectedRoutes(exclude)
+}
+
+func (r *Recorder) LinkDown(iface string) error {
+	var diff []string
+	if _, err := netlink.LinkByName(iface); err == nil {
+		diff = append(diff, "- link "+iface)
+	}
+
+	r.record("link-down", []string{"delete link " + iface}, diff)
+	return nil
+}
+
+func (r *Recorder) SetExitPolicy(p ExitPolicy) error {
+	var config, diff []string
+
+	routes, err := installedExitRoutes(p.Table)
+	if err != nil {
+		diff = append(diff, fmt.Sprintf("? routes unknown: %v", err))
+	}
+
+	routed := make(map[int]bool)
+	for _, dst := range p.Dsts {
+		routed[addrFamily(dst.Addr())] = true
+		config = append(config, formatExitRoute(p, dst))
+
+		found := false
+		for _, route := range routes {
+			found = found || route.Family == addrFamily(dst.Addr())
+		}
+		if !found && err == nil {
+			diff = append(diff, "+ "+formatExitRoute(p, dst))
+		}
+	}
+
+	for _, route := range routes {
+		if !routed[route.Family] {
+			diff = append(diff, fmt.Sprintf("- route %s default table %d", familyName(route.Family), p.Table))
+		}
+	}
+
+	wanted := exitRules(p)
+	installed, err := installedExitRules()
+	if err != nil {
+		diff = append(diff, fmt.Sprintf("? rules unknown: %v", err))
+	}
+
+	for key := range wanted {
+		config = append(config, key)
+		if _, ok := installed[key]; !ok && err == nil {
+			diff = append(diff, "+ "+key)
+		}
+	}
+
+	for key := range installed {
+		if _, ok := wanted[key]; !ok {
+			diff = append(diff, "- "+key)
+		}
+	}
+
+	sort.Strings(config)
+	sort.Strings(diff)
+
+	r.record("exit-policy", config, diff)
+	return nil
+}
+
+func (r *Recorder) SetMasquerade(m Masquerade) error {
+	var config, diff []string
+
+	for _, version := range forwardingVersions(m) {
+		config = append(config, fmt.Sprintf("%s = 1", forwardingSysctls[version]))
+
+		enabled, err := forwardingEnabled(version)
+		switch {
+		case err != nil:
+			diff = append(diff, fmt.Sprintf("? %s unknown: %v", forwardingSysctls[version], err))
+		case !enabled:
+			diff = append(diff, fmt.Sprintf("~ %s = 1", forwardingSysctls[version]))
+		}
+	}
+
+	wanted := masqueradeRules(m)
+
+	r.lock.Lock()
+	for key, rule := range wanted {
+		config = append(config, key)
+		if !rule.exists() {
+			diff = append(diff, "+ "+key)
+		}
+		r.masquerade[key] = rule
+	}
+
+	for key, rule := range r.masquerade {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+
+		if rule.exists() {
+			diff = append(diff, "- "+key)
+		}
+		delete(r.masquerade, key)
+	}
+	r.lock.Unlock()
+
+	sort.Strings(config)
+	sort.Strings(diff)
+
+	r.record("masquerade", config, diff)
+	return nil
+}
+
+func (r *Recorder) Device(iface string) (*wgtypes.Device, error) {
+	return r.client.Device(iface)
+}
+
+// diffDevice lists the changes cfg would make to the device.
+func diffDevice(device *wgtypes.Device, cfg wgtypes.Config) []string {
+	var diff []string
+
+	if cfg.PrivateKey != nil && *cfg.PrivateKey != device.PrivateKey {
+		diff = append(diff, "~ private-key")
+	}
+
+	if cfg.ListenPort != nil && *cfg.ListenPort != device.ListenPort {
+		diff = append(diff, fmt.Sprintf("~ listen-port %d -> %d", device.ListenPort, *cfg.ListenPort))
+	}
+
+	var (
+		current    = make(map[wgtypes.Key]wgtypes.Peer)
+		configured = make(map[wgtypes.Key]bool)
+	)
+	for _, p := range device.Peers {
+		current[p.PublicKey] = p
+	}
+
+	for _, p := range cfg.Peers {
+		configured[p.PublicKey] = true
+
+		existing, ok := current[p.PublicKey]
+		switch {
+		case p.Remove && ok:
+			diff = append(diff, fmt.Sprintf("- peer %s", p.PublicKey))
+		case p.Remove:
+			// nothing to remove
+		case !ok:
+			diff = append(diff, "+ "+formatPeerConfig(p))
+		default:
+			diff = append(diff, diffPeer(existing, p)...)
+		}
+	}
+
+	if cfg.ReplacePeers {
+		for _, p := range device.Peers {
+			if !configured[p.PublicKey] {
+				diff = append(diff, fmt.Sprintf("- peer %s", p.PublicKey))
+			}
+		}
+	}
+
+	return diff
+}
+
+func diffPeer(existing wgtypes.Peer, p wgtypes.PeerConfig) []string {
+	var diff []string
+
+	if p.Endpoint != nil && (existing.Endpoint == nil || existing.Endpoint.String() != p.Endpoint.String()) {
+		diff = append(diff, fmt.Sprintf("~ peer %s endpoint %v -> %v", p.PublicKey, existing.Endpoint, p.Endpoint))
+	}
+
+	if p.PersistentKeepaliveInterval != nil && *p.PersistentKeepaliveInterval != existing.PersistentKeepaliveInterval {
+		diff = append(diff, fmt.Sprintf("~ peer %s persistent-keepalive %v -> %v",
+			p.PublicKey, existing.PersistentKeepaliveInterval, *p.PersistentKeepaliveInterval))
+	}
+
+	if p.PresharedKey != nil && *p.PresharedKey != existing.PresharedKey {
+		diff = append(diff, fmt.Sprintf("~ peer %s preshared-key", p.PublicKey))
+	}
+
+	var (
+		was = formatIPNets(existing.AllowedIPs)
+		now = formatIPNets(p.AllowedIPs)
+	)
+	if !p.ReplaceAllowedIPs {
+		now = formatIPNets(append(append([]net.IPNet{}, existing.AllowedIPs...), p.AllowedIPs...))
+	}
+	if strings.Join(was, ",") != strings.Join(now, ",") {
+		diff = append(diff, fmt.Sprintf("~ peer %s allowed-ips %s -> %s",
+			p.PublicKey, strings.Join(was, ","), strings.Join(now, ",")))
+	}
+
+	return diff
+}
+
+func formatPeerConfig(p wgtypes.PeerConfig) string {
+	if p.Remove {
+		return fmt.Sprintf("peer %s remove", p.PublicKey)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "peer %s", p.PublicKey)
+	if p.Endpoint != nil {
+		fmt.Fprintf(&b, " endpoint %s", p.Endpoint)
+	}
+	fmt.Fprintf(&b, " allowed-ips %s", strings.Join(formatIPNets(p.AllowedIPs), ","))
+	if p.PersistentKeepaliveInterval != nil {
+		fmt.Fprintf(&b, " persistent-keepalive %s", *p.PersistentKeepaliveInterval)
+	}
+	if p.PresharedKey != nil {
+		b.WriteString(" preshared-key <redacted>")
+	}
+
+	return b.String()
+}
+
+// formatIPNets returns the sorted unique list of the networks.
+func formatIPNets(nets []net.IPNet) []string {
+	var seen = make(map[string]bool)
+	var ret []string
+	for _, n := range nets {
+		s := n.String()
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			s = prefix.Masked().String()
+		}
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
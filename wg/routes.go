@@ -0,0 +1,198 @@
+package wg
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/derlaft/w2wesher/networkstate"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// minRouteBits are the shortest prefixes accepted without being listed in AcceptRoutes:
+// a pair of /1 routes would take over all the traffic as well as the default route.
+var minRouteBits = map[int]int{
+	32:  8,
+	128: 16,
+}
+
+// acceptedRoutes returns the routes announced by the live peers which are installed:
+// the losers of the route conflicts and the routes refused by acceptRoute are skipped.
+func (s *State) acceptedRoutes(nodes []networkstate.Info) map[peer.ID][]netip.Prefix {
+	var (
+		accepted = make(map[peer.ID][]netip.Prefix)
+		rejected = make(map[peer.ID]map[string]bool)
+		reported = make(map[string]bool)
+		refused  = make(map[string]bool)
+	)
+
+	for _, c := range s.state.RouteConflicts(s.selfID, s.AnnounceInfo(), s.leaseExpiry) {
+		key := fmt.Sprint(c)
+		reported[key] = true
+		if !s.routeConflicts[key] {
+			log.
+				With("route", c.Route).
+				With("peer", c.Peer).
+				With("overlaps", c.Overlaps).
+				With("winner", c.Winner).
+				Error("route conflict detected")
+		}
+
+		if rejected[c.Peer] == nil {
+			rejected[c.Peer] = make(map[string]bool)
+		}
+		rejected[c.Peer][c.Route] = true
+	}
+	s.routeConflicts = reported
+
+	var endpoints []netip.Addr
+	for _, node := range nodes {
+		addr, err := netip.ParseAddr(node.Addr)
+		if err == nil {
+			endpoints = append(endpoints, addr.Unmap())
+		}
+	}
+
+	connected, err := s.backend.ConnectedRoutes(s.iface)
+	if err != nil {
+		log.With("err", err).Warn("could not list the connected routes")
+	}
+
+	for _, node := range nodes {
+		as := node.LastAnnounce.WireguardState
+		if node.ID == s.selfID || !as.IsValid() || s.expired(node) {
+			continue
+		}
+
+		for _, raw := range as.Routes {
+			prefix, err := netip.ParsePrefix(raw)
+			if err != nil {
+				log.
+					With("peer", node.ID).
+					With("route", raw).
+					With("err", err).
+					Warn("invalid announced route")
+				continue
+			}
+			prefix = prefix.Masked()
+
+			if rejected[node.ID][prefix.String()] {
+				continue
+			}
+
+			err = s.acceptRoute(prefix, endpoints, connected)
+			if err != nil {
+				key := fmt.Sprint(node.ID, prefix, err)
+				refused[key] = true
+				if !s.refusedRoutes[key] {
+					log.
+						With("peer", node.ID).
+						With("route", prefix).
+						With("err", err).
+						Warn("announced route not accepted")
+				}
+				continue
+			}
+
+			accepted[node.ID] = append(accepted[node.ID], prefix)
+		}
+	}
+	s.refusedRoutes = refused
+
+	return accepted
+}
+
+// acceptRoute checks the announced route against the local settings and the network:
+// the routes which would take over the traffic of the mesh itself are refused.
+func (s *State) acceptRoute(route netip.Prefix, endpoints []netip.Addr, connected []netip.Prefix) error {
+	if route.Bits() == 0 {
+		// never hijack the default route
+		return fmt.Errorf("default route")
+	}
+
+	if route.Overlaps(s.overlayPrefix) || (s.overlayPrefix4.IsValid() && route.Overlaps(s.overlayPrefix4)) {
+		return fmt.Errorf("overlaps the overlay network")
+	}
+
+	for _, own := range s.routes {
+		if route.Overlaps(own) {
+			// the local network wins
+			return fmt.Errorf("overlaps own route %s", own)
+		}
+	}
+
+	for _, c := range connected {
+		if route.Overlaps(c) {
+			return fmt.Errorf("overlaps connected network %s", c)
+		}
+	}
+
+	for _, addr := range endpoints {
+		if route.Contains(addr) {
+			// the wireguard packets to the peer would be routed into the tunnel
+			return fmt.Errorf("contains the endpoint %s of a peer", addr)
+		}
+	}
+
+	var listed, explicit bool
+	for _, allowed := range s.acceptRoutes {
+		if allowed.Bits() <= route.Bits() && allowed.Contains(route.Addr()) {
+			listed = true
+			// the default route does not list the short routes explicitly
+			explicit = explicit || allowed.Bits() > 0
+		}
+	}
+
+	if min := minRouteBits[route.Addr().BitLen()]; route.Bits() < min && !explicit {
+		return fmt.Errorf("prefix shorter than /%d is not listed in AcceptRoutes", min)
+	}
+
+	if len(s.acceptRoutes) > 0 && !listed {
+		return fmt.Errorf("not listed in AcceptRoutes")
+	}
+
+	return nil
+}
+
+// syncRoutes installs the kernel routes of the accepted routes
+// and removes the ones not accepted anymore.
+func (s *State) syncRoutes(accepted map[peer.ID][]netip.Prefix) error {
+	wanted := make(map[netip.Prefix]bool)
+	for _, routes := range accepted {
+		for _, route := range routes {
+			wanted[route] = true
+		}
+	}
+
+	for route := range wanted {
+		if !s.installedRoutes[route] {
+			log.With("route", route).Info("adding announced route")
+		}
+
+		// re-added every time in case it was removed
+		err := s.backend.RouteAdd(Route{
+			Link: s.iface,
+			Dst:  route,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for route := range s.installedRoutes {
+		if wanted[route] {
+			continue
+		}
+
+		log.With("route", route).Info("removing route which is no longer announced")
+		err := s.backend.RouteDel(Route{
+			Link: s.iface,
+			Dst:  route,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.installedRoutes = wanted
+	return nil
+}
@@ -0,0 +1,198 @@
+package wg
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+
+	"github.com/derlaft/w2wesher/config"
+	"github.com/derlaft/w2wesher/networkstate"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// sponsoredPeer is a static peer with its sponsor.
+type sponsoredPeer struct {
+	sponsor string
+	peer    networkstate.StaticPeer
+}
+
+// staticPeerConfigs returns the configs of the static peers sponsored by this node
+// and the rest of the mesh. Unlike the mesh members, static peers which are
+// no longer announced are removed from the device.
+// The keys of the installed static peers are returned as well.
+func (s *State) staticPeerConfigs(nodes []networkstate.Info, members []wgtypes.PeerConfig) ([]wgtypes.PeerConfig, map[wgtypes.Key]bool) {
+	var (
+		peerCfgs  []wgtypes.PeerConfig
+		installed = make(map[wgtypes.Key]bool)
+		taken     = map[wgtypes.Key]bool{s.pubKey: true}
+		claimed   = s.claimedPrefixes()
+	)
+
+	for _, m := range members {
+		taken[m.PublicKey] = true
+		for _, ipNet := range m.AllowedIPs {
+			if prefix := ipNetToPrefix(ipNet); prefix.Bits() > 0 {
+				// the default routes of the exit node overlap everything
+				claimed = append(claimed, prefix)
+			}
+		}
+	}
+
+	for _, sp := range s.sponsoredPeers(nodes) {
+		key, err := wgtypes.ParseKey(sp.peer.PublicKey)
+		if err != nil || taken[key] {
+			// first sponsor wins
+			continue
+		}
+		taken[key] = true
+
+		cfg := wgtypes.PeerConfig{
+			PublicKey:                   key,
+			ReplaceAllowedIPs:           true,
+			PersistentKeepaliveInterval: s.persistentKeepalive,
+		}
+
+		var allowed []netip.Prefix
+		for _, raw := range sp.peer.AllowedIPs {
+			prefix, err := netip.ParsePrefix(raw)
+			if err == nil {
+				err = s.checkStaticPrefix(prefix.Masked(), claimed)
+			}
+			if err != nil {
+				log.
+					With("peer", sp.peer.Name).
+					With("sponsor", sp.sponsor).
+					With("allowed", raw).
+					With("err", err).
+					Warn("invalid static peer allowed ip")
+				continue
+			}
+
+			allowed = append(allowed, prefix.Masked())
+			cfg.AllowedIPs = append(cfg.AllowedIPs, *prefixToIPNet(prefix.Masked()))
+		}
+		// the later static peers can not take over the prefixes of this one
+		claimed = append(claimed, allowed...)
+
+		if sp.peer.Endpoint != "" {
+			// the announced endpoints are never resolved: the sponsor announces the resolved ones
+			endpoint, err := netip.ParseAddrPort(sp.peer.Endpoint)
+			if err != nil {
+				log.
+					With("peer", sp.peer.Name).
+					With("sponsor", sp.sponsor).
+					With("err", err).
+					Warn("invalid static peer endpoint, only ip:port is accepted")
+			} else {
+				cfg.Endpoint = net.UDPAddrFromAddrPort(endpoint)
+			}
+		}
+
+		peerCfgs = append(peerCfgs, cfg)
+		installed[key] = true
+	}
+
+	for key := range s.installedStatic {
+		if !installed[key] {
+			log.With("key", key).Info("removing static peer which is no longer announced")
+			peerCfgs = append(peerCfgs, wgtypes.PeerConfig{
+				PublicKey: key,
+				Remove:    true,
+			})
+		}
+	}
+
+	return peerCfgs, installed
+}
+
+// claimedPrefixes returns the addresses and the routes of this node.
+func (s *State) claimedPrefixes() []netip.Prefix {
+	var claimed []netip.Prefix
+
+	addr, addr4 := s.overlayAddrs()
+	for _, a := range []netip.Addr{addr, addr4} {
+		if a.IsValid() {
+			claimed = append(claimed, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+
+	return append(claimed, s.routes...)
+}
+
+// checkStaticPrefix makes sure the allowed ip of the static peer does not steal
+// the traffic of the mesh: only single addresses are allowed inside the overlay networks,
+// and the addresses and routes of the members are never taken over.
+func (s *State) checkStaticPrefix(prefix netip.Prefix, claimed []netip.Prefix) error {
+	if prefix.Bits() == 0 {
+		return fmt.Errorf("default route is not allowed")
+	}
+
+	for _, overlay := range []netip.Prefix{s.overlayPrefix, s.overlayPrefix4} {
+		if !overlay.IsValid() || !prefix.Overlaps(overlay) {
+			continue
+		}
+		if !overlay.Contains(prefix.Addr()) || prefix.Bits() != prefix.Addr().BitLen() {
+			return fmt.Errorf("only single addresses are allowed inside the overlay network %s", overlay)
+		}
+	}
+
+	for _, c := range claimed {
+		if prefix.Overlaps(c) {
+			return fmt.Errorf("overlaps %s of the mesh", c)
+		}
+	}
+
+	return nil
+}
+
+// sponsoredPeers lists the static peers of this node first,
+// then the ones announced by the others ordered by the sponsor.
+func (s *State) sponsoredPeers(nodes []networkstate.Info) []sponsoredPeer {
+	var own, others []sponsoredPeer
+
+	for _, p := range s.StaticPeers() {
+		own = append(own, sponsoredPeer{"self", p})
+	}
+
+	for _, node := range nodes {
+		for _, p := range node.LastAnnounce.StaticPeers {
+			others = append(others, sponsoredPeer{node.ID.String(), p})
+		}
+	}
+
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].sponsor < others[j].sponsor
+	})
+
+	return append(own, others...)
+}
+
+// resolveStaticPeers returns the static peers to announce with the endpoints resolved to ip:port.
+// The endpoints which can not be resolved are left out.
+func resolveStaticPeers(peers []config.StaticPeer) []networkstate.StaticPeer {
+	var resolved []networkstate.StaticPeer
+
+	for _, p := range peers {
+		sp := p.Announce()
+
+		if sp.Endpoint != "" {
+			endpoint, err := net.ResolveUDPAddr("udp", sp.Endpoint)
+			if err != nil {
+				log.
+					With("peer", sp.Name).
+					With("endpoint", sp.Endpoint).
+					With("err", err).
+					Warn("could not resolve static peer endpoint")
+				sp.Endpoint = ""
+			} else {
+				addrPort := endpoint.AddrPort()
+				sp.Endpoint = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()).String()
+			}
+		}
+
+		resolved = append(resolved, sp)
+	}
+
+	return resolved
+}
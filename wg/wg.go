@@ -4,12 +4,18 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
+	"os"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/derlaft/w2wesher/config"
 	"github.com/derlaft/w2wesher/networkstate"
 	logging "github.com/ipfs/go-log/v2"
-	"golang.zx2c4.com/wireguard/wgctrl"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/atomic"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/exp/slices"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -21,6 +27,16 @@ type Adapter interface {
 	Run(context.Context) error
 	AnnounceInfo() networkstate.WireguardState
 	Update()
+	Reload(context.Context, *config.Config)
+	OpenSealed([]byte) ([]byte, error)
+	Device() (*wgtypes.Device, error)
+	RotateKey() (wgtypes.Key, time.Time, error)
+	MTU() int
+	SelectExitNode(string) error
+	ExitNode() (string, bool)
+	SetNetworkPSK([]byte)
+	Changed() <-chan struct{}
+	StaticPeers() []networkstate.StaticPeer
 }
 
 func (s *State) Run(ctx context.Context) error {
@@ -30,6 +46,12 @@ func (s *State) Run(ctx context.Context) error {
 		return err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go s.answerMTUProbes(ctx)
+	go s.discoverMTU(ctx)
+
 	defer func() {
 		err = s.InterfaceDown()
 		if err != nil {
@@ -38,22 +60,71 @@ func (s *State) Run(ctx context.Context) error {
 	}()
 
 	t := time.NewTicker(peerUpdateInterval)
+
+	keyTimer := time.NewTimer(0)
+	<-keyTimer.C
+	defer keyTimer.Stop()
+	s.resetKeyTimer(keyTimer)
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
+		case <-s.keyChanged:
+			s.resetKeyTimer(keyTimer)
+		case <-keyTimer.C:
+			err := s.switchKey()
+			if err != nil {
+				return err
+			}
 		case <-s.forceUpdate:
 			// force update
 			err := s.UpdatePeers()
 			if err != nil {
 				return err
 			}
+		case c := <-s.mtuChanged:
+			if !s.mtuAuto.Load() {
+				// switched to the fixed MTU while the discovery was running
+				close(c.done)
+				continue
+			}
+
+			s.mtu.Store(int32(c.mtu))
+			err := s.InterfaceUp()
+			close(c.done)
+			if err != nil {
+				return err
+			}
+		case cfg := <-s.reload:
+			// apply the new settings to all the peers
+			s.applyLive(cfg.Wireguard)
+			s.keyLock.Lock()
+			s.cfg = cfg
+			s.keyLock.Unlock()
+			err := s.InterfaceUp()
+			if err != nil {
+				return err
+			}
+			err = s.UpdatePeers()
+			if err != nil {
+				return err
+			}
 		case <-t.C:
 			// periodic peer update
 			err := s.InterfaceUp()
 			if err != nil {
 				return err
 			}
+			s.autoRotateKey()
+			err = s.maintainLease()
+			if err != nil {
+				return err
+			}
+			err = s.removeDeparted()
+			if err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -61,62 +132,184 @@ func (s *State) Run(ctx context.Context) error {
 // State holds the configured state of a Wesher Wireguard interface.
 type State struct {
 	// network interface settings
-	iface  string
-	client *wgctrl.Client
+	iface   string
+	backend Backend
+	// wireguard keys, see keys.go;
+	// keyLock protects the overlay addrs as well
+	keyLock       sync.RWMutex
+	privKey       wgtypes.Key
+	pubKey        wgtypes.Key
+	nextPrivKey   *wgtypes.Key
+	keyActivation time.Time
+	keyChanged    chan struct{}
+	// cfg is used for the key rotation, protected by keyLock
+	cfg *config.Config
+	// network PSK the preshared keys are derived from, see psk.go;
+	// both are protected by keyLock
+	networkPSK  []byte
+	pskRotation time.Duration
 	// wireguard settings
-	privKey             wgtypes.Key
-	pubKey              wgtypes.Key
 	persistentKeepalive *time.Duration
+	keyRotationInterval time.Duration
 	listenPort          int
-	// overlay network address of this node
+	// interface MTU, see mtu.go
+	mtu         *atomic.Int32
+	mtuAuto     *atomic.Bool
+	mtuEvaluate chan struct{}
+	mtuChanged  chan mtuChange
+	// libp2p identity of this node, used for the address conflicts
+	selfID peer.ID
+	// overlay addresses are derived from the node name and the salt, see addr.go
+	nodeName string
+	addrSalt int
+	// leased addresses, see lease.go; claim is protected by keyLock
+	claim       string
+	proposedAt  time.Time
+	leaseExpiry time.Duration
+	// departed peers are removed after peerTTL, see gc.go
+	peerTTL time.Duration
+	// reported address conflicts, see conflict.go
+	conflicts map[string]bool
+	// routes announced by this node and accepted from the others, see routes.go
+	routes          []netip.Prefix
+	acceptRoutes    []netip.Prefix
+	installedRoutes map[netip.Prefix]bool
+	routeConflicts  map[string]bool
+	refusedRoutes   map[string]bool
+	// invalid announces of the members, reported once
+	refusedPeers map[string]bool
+	// exit node settings, see exit.go
+	exitNode       bool
+	exitMasquerade bool
+	exitActive     *atomic.Bool
+	// the leftovers of the exit policy are removed by the first update
+	exitSynced bool
+	// the missing NetworkRange4 is reported once
+	exitRefused bool
+	// notifies the MTU probes responder about the new address
+	readdressed chan struct{}
+	// notifies about the changes of AnnounceInfo
+	changed chan struct{}
+	// overlay network address of this node, protected by keyLock
 	overlayAddr netip.Addr
 	// overlay network prefix
 	overlayPrefix netip.Prefix
+	// optional IPv4 overlay network, the addr is protected by keyLock
+	overlayAddr4   netip.Addr
+	overlayPrefix4 netip.Prefix
 	// state of the whole mesh network
 	state *networkstate.State
+	// static peers sponsored by this node with the resolved endpoints, protected by keyLock
+	staticPeers []networkstate.StaticPeer
+	// static peers configured on the device, removed once not announced
+	installedStatic map[wgtypes.Key]bool
+	// keys of the mesh members configured on the device,
+	// the old ones are removed after the key rotation
+	installedMembers map[peer.ID][]wgtypes.Key
+	// scheduled updates for the key rotations of the others
+	wakeups     map[int64]bool
+	wakeupsLock sync.Mutex
 	// peers update channel
 	forceUpdate chan struct{}
+	// config reload channel
+	reload chan *config.Config
 }
 
 // New creates a new Wesher Wireguard state.
 // The Wireguard keys are generated for every new interface.
 // The interface must later be setup using SetUpInterface.
-func New(cfg *config.Config, state *networkstate.State) (Adapter, error) {
+// All the changes to the system are made via the backend.
+func New(cfg *config.Config, state *networkstate.State, backend Backend) (Adapter, error) {
 
 	c := cfg.Wireguard
 
-	client, err := wgctrl.New()
-	if err != nil {
-		return nil, fmt.Errorf("instantiating wireguard client: %w", err)
-	}
-
 	privKey, err := wgtypes.ParseKey(c.PrivateKey)
 	if err != nil {
 		return nil, fmt.Errorf("loading private key: %w", err)
 	}
 	pubKey := privKey.PublicKey()
 
+	networkPSK, err := cfg.P2P.LoadPsk()
+	if err != nil {
+		return nil, fmt.Errorf("loading network PSK: %w", err)
+	}
+
 	prefix, err := netip.ParsePrefix(c.NetworkRange)
 	if err != nil {
 		return nil, fmt.Errorf("parsing CIDR: %w", err)
 	}
 
+	var prefix4 netip.Prefix
+	if c.NetworkRange4 != "" {
+		prefix4, err = netip.ParsePrefix(c.NetworkRange4)
+		if err != nil {
+			return nil, fmt.Errorf("parsing IPv4 CIDR: %w", err)
+		}
+	}
+
 	s := State{
-		iface:         c.Interface,
-		client:        client,
-		listenPort:    c.ListenPort,
-		privKey:       privKey,
-		pubKey:        pubKey,
-		state:         state,
-		forceUpdate:   make(chan struct{}),
-		overlayPrefix: prefix,
+		iface:            c.Interface,
+		backend:          backend,
+		listenPort:       c.ListenPort,
+		privKey:          privKey,
+		pubKey:           pubKey,
+		networkPSK:       networkPSK,
+		state:            state,
+		forceUpdate:      make(chan struct{}, 1),
+		reload:           make(chan *config.Config),
+		overlayPrefix:    prefix,
+		overlayPrefix4:   prefix4,
+		installedStatic:  make(map[wgtypes.Key]bool),
+		cfg:              cfg,
+		keyChanged:       make(chan struct{}, 1),
+		installedMembers: make(map[peer.ID][]wgtypes.Key),
+		wakeups:          make(map[int64]bool),
+		mtu:              atomic.NewInt32(0),
+		mtuAuto:          atomic.NewBool(false),
+		mtuEvaluate:      make(chan struct{}, 1),
+		mtuChanged:       make(chan mtuChange),
+		conflicts:        make(map[string]bool),
+		installedRoutes:  make(map[netip.Prefix]bool),
+		routeConflicts:   make(map[string]bool),
+		refusedRoutes:    make(map[string]bool),
+		refusedPeers:     make(map[string]bool),
+		exitNode:         c.ExitNode,
+		exitMasquerade:   c.ExitNodeMasquerade,
+		exitActive:       atomic.NewBool(false),
+		readdressed:      make(chan struct{}, 1),
+		changed:          make(chan struct{}, 1),
 	}
 
-	if c.PersistentKeepalive > 0 {
-		s.persistentKeepalive = &c.PersistentKeepalive
+	s.applyLive(c)
+	s.staticPeers = resolveStaticPeers(cfg.StaticPeers)
+
+	s.routes, err = c.ParseRoutes()
+	if err != nil {
+		return nil, fmt.Errorf("parsing routes: %w", err)
 	}
 
-	if err := s.assignOverlayAddr(c.NodeName); err != nil {
+	err = s.resumeKeyRotation()
+	if err != nil {
+		return nil, err
+	}
+
+	s.nodeName = c.NodeName
+	if s.nodeName == "" {
+		s.nodeName, _ = os.Hostname()
+	}
+	s.addrSalt = cfg.State().AddrSalt(s.nodeName)
+
+	pk, err := cfg.P2P.LoadPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	s.selfID, err = peer.IDFromPrivateKey(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.chooseAddrs(cfg); err != nil {
 		return nil, fmt.Errorf("assigning overlay address: %w", err)
 	}
 
@@ -124,20 +317,128 @@ func New(cfg *config.Config, state *networkstate.State) (Adapter, error) {
 }
 
 func (s *State) AnnounceInfo() networkstate.WireguardState {
-	return networkstate.WireguardState{
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	ws := networkstate.WireguardState{
 		PublicKey:    s.pubKey.String(),
 		SelectedAddr: s.overlayAddr.String(),
+		Claim:        s.claim,
 		Port:         s.listenPort,
+		ExitNode:     s.exitNode,
+		PSKVersion:   PresharedKeyVersion,
+		PSKRotation:  int64(s.pskRotation / time.Second),
+	}
+
+	for _, route := range s.routes {
+		ws.Routes = append(ws.Routes, route.String())
+	}
+
+	if s.overlayAddr4.IsValid() {
+		ws.SelectedAddr4 = s.overlayAddr4.String()
+	}
+
+	if s.nextPrivKey != nil {
+		ws.NextPublicKey = s.nextPrivKey.PublicKey().String()
+		ws.NextKeyActivation = s.keyActivation.Unix()
 	}
+
+	return ws
+}
+
+// StaticPeers returns the static peers sponsored by this node to announce.
+func (s *State) StaticPeers() []networkstate.StaticPeer {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	return slices.Clone(s.staticPeers)
 }
 
-func (s State) Update() {
+// Changed notifies about the changes which have to be announced right away.
+func (s *State) Changed() <-chan struct{} {
+	return s.changed
+}
+
+func (s *State) notifyChanged() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// already notified
+	}
+}
+
+func (s *State) Update() {
 	select {
 	case s.forceUpdate <- struct{}{}:
 		// force-update sent
 	default:
-		// Run loop is not waiting right now:
-		// it's either not started/stopped
-		// or already updating
+		// update is already pending
+	}
+}
+
+// Reload applies the settings which can be changed without a restart.
+func (s *State) Reload(ctx context.Context, cfg *config.Config) {
+	// resolved here, the Run loop never waits for DNS
+	peers := resolveStaticPeers(cfg.StaticPeers)
+
+	s.keyLock.Lock()
+	changed := !reflect.DeepEqual(s.staticPeers, peers)
+	s.staticPeers = peers
+	s.keyLock.Unlock()
+
+	if changed {
+		// let the others know about the changed static peers right away
+		s.notifyChanged()
 	}
+
+	select {
+	case s.reload <- cfg:
+	case <-ctx.Done():
+	}
+}
+
+// applyLive applies the settings which can be changed in runtime.
+func (s *State) applyLive(c config.Wireguard) {
+	keepalive := c.PersistentKeepalive
+	if keepalive < 0 {
+		// explicitly disabled
+		keepalive = 0
+	}
+	s.persistentKeepalive = &keepalive
+	s.keyRotationInterval = c.KeyRotationInterval
+	s.leaseExpiry = c.LeaseExpiry
+	s.peerTTL = c.PeerTTL
+	s.acceptRoutes, _ = c.ParseAcceptRoutes()
+
+	s.keyLock.Lock()
+	changed := s.pskRotation != c.PresharedKeyRotation
+	s.pskRotation = c.PresharedKeyRotation
+	s.keyLock.Unlock()
+	if changed {
+		// the peers have to learn the new interval
+		s.notifyChanged()
+	}
+	s.applyMTU(c)
+}
+
+// OpenSealed decrypts the data sealed for the wireguard public key of this node.
+func (s *State) OpenSealed(sealed []byte) ([]byte, error) {
+	s.keyLock.RLock()
+	var (
+		pub  = [32]byte(s.pubKey)
+		priv = [32]byte(s.privKey)
+	)
+	s.keyLock.RUnlock()
+
+	data, ok := box.OpenAnonymous(nil, sealed, &pub, &priv)
+	if !ok {
+		return nil, fmt.Errorf("could not open sealed data")
+	}
+
+	return data, nil
+}
+
+// Device returns the current state of the wireguard interface.
+func (s *State) Device() (*wgtypes.Device, error) {
+	return s.backend.Device(s.iface)
 }